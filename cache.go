@@ -0,0 +1,365 @@
+package saving
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+const (
+	// CacheHeader is a response header that tells the response came from saving's cache.
+	CacheHeader = "X-Saving-Cache"
+	// DefaultCacheEntries is maximum count of cached responses.
+	DefaultCacheEntries = 1000
+	// DefaultCacheSize is default total body size of cached responses.
+	DefaultCacheSize = 32 << 20
+	// DefaultCacheBodySize is default maximum body size of each cached response.
+	DefaultCacheBodySize = 256 << 10
+)
+
+// CacheSaveInterval is interval to save the cache file while running, so a crash doesn't lose all entries.
+var CacheSaveInterval = time.Minute
+
+// CacheEntry is a stored GET response.
+type CacheEntry struct {
+	StatusCode           int
+	Header               http.Header
+	Body                 []byte
+	Stored               time.Time
+	MaxAge               time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+func (e *CacheEntry) fresh(now time.Time) bool {
+	return now.Sub(e.Stored) < e.MaxAge
+}
+
+// staleAllowed reports whether the entry can be served while the server process is sleeping.
+func (e *CacheEntry) staleAllowed(now time.Time, maxStale time.Duration) bool {
+	stale := max(e.StaleWhileRevalidate, e.StaleIfError, maxStale)
+	return now.Sub(e.Stored) < e.MaxAge+stale
+}
+
+// CacheOption is settings of ResponseCache.
+type CacheOption struct {
+	Path        string        // File to persist entries. Empty means not persisted
+	MaxStale    time.Duration // Serve stale entries within this duration while the server process is sleeping
+	MaxSize     uint64        // Total body size of entries. 0 means DefaultCacheSize
+	MaxBodySize uint64        // Body size of each entry. 0 means DefaultCacheBodySize
+	Clock       clock.Clock   // Clock for entry ages. nil means real time
+}
+
+// ResponseCache is a small shared cache that honors Cache-Control.
+//
+// Fresh responses are served without waking the server process. While the server process
+// is sleeping, stale responses are served too if stale-while-revalidate, stale-if-error or
+// maxStale allows. The oldest entries are evicted to keep the total body size within maxSize.
+type ResponseCache struct {
+	lock        sync.Mutex
+	entries     map[string]*CacheEntry
+	size        uint64 // total body size of entries
+	maxSize     uint64
+	maxBodySize uint64
+	maxStale    time.Duration
+	path        string
+	clock       clock.Clock
+	dirty       bool // entries are changed after the last Save
+}
+
+// NewResponseCache creates cache. If opt.Path is not empty, it loads entries stored by Save.
+func NewResponseCache(opt CacheOption) (*ResponseCache, error) {
+	result := &ResponseCache{
+		entries:     make(map[string]*CacheEntry),
+		maxSize:     opt.MaxSize,
+		maxBodySize: opt.MaxBodySize,
+		maxStale:    opt.MaxStale,
+		path:        opt.Path,
+		clock:       clock.OrReal(opt.Clock),
+	}
+	if result.maxSize == 0 {
+		result.maxSize = DefaultCacheSize
+	}
+	if result.maxBodySize == 0 {
+		result.maxBodySize = DefaultCacheBodySize
+	}
+	result.maxBodySize = min(result.maxBodySize, result.maxSize)
+	if opt.Path == "" {
+		return result, nil
+	}
+	f, err := os.Open(opt.Path)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries map[string]*CacheEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+	now := result.clock.Now()
+	for key, entry := range entries {
+		if entry.staleAllowed(now, opt.MaxStale) {
+			result.add(key, entry)
+		}
+	}
+	return result, nil
+}
+
+// Save stores entries to the file specified in NewResponseCache. It does nothing if no entries are changed.
+//
+// The file is replaced atomically, so a crash during Save keeps the previous file.
+func (c *ResponseCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.lock.Lock()
+	if !c.dirty {
+		c.lock.Unlock()
+		return nil
+	}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(c.entries)
+	c.dirty = false
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buffer.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// startCacheSaver saves cache every interval until ctx is done.
+func startCacheSaver(ctx context.Context, cache *ResponseCache, interval time.Duration, clk clock.Clock, logger *slog.Logger) {
+	if cache.path == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := clock.OrReal(clk).NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+			}
+			if err := cache.Save(); err != nil {
+				logger.Warn("cache save error", "detail", err.Error())
+			}
+		}
+	}()
+}
+
+func (c *ResponseCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func (c *ResponseCache) get(key string) *CacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+func (c *ResponseCache) put(key string, entry *CacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.add(key, entry) {
+		c.dirty = true
+	}
+}
+
+// add stores entry and evicts the oldest entries over the limits. It returns false if the body is too large.
+func (c *ResponseCache) add(key string, entry *CacheEntry) bool {
+	size := uint64(len(entry.Body))
+	if size > c.maxBodySize {
+		return false
+	}
+	if old, ok := c.entries[key]; ok {
+		c.size -= uint64(len(old.Body))
+		delete(c.entries, key)
+	}
+	for len(c.entries) >= DefaultCacheEntries || c.size+size > c.maxSize {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range c.entries {
+			if oldestKey == "" || e.Stored.Before(oldest) {
+				oldestKey = k
+				oldest = e.Stored
+			}
+		}
+		c.size -= uint64(len(c.entries[oldestKey].Body))
+		delete(c.entries, oldestKey)
+	}
+	c.entries[key] = entry
+	c.size += size
+	return true
+}
+
+// cacheKey returns key of the request. scope separates ports that share the cache,
+// so a response from one upstream is never served for another upstream.
+func cacheKey(scope string, r *http.Request) string {
+	return scope + " " + r.Host + r.URL.RequestURI()
+}
+
+func parseCacheControl(src string) map[string]string {
+	result := make(map[string]string)
+	for _, directive := range strings.Split(src, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if key != "" {
+			result[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return result
+}
+
+func parseSeconds(src string) time.Duration {
+	seconds, err := strconv.ParseInt(src, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// newCacheEntry creates entry from response. It returns nil if the response is not cacheable.
+func newCacheEntry(statusCode int, header http.Header, body []byte, now time.Time) *CacheEntry {
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return nil
+	}
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") != "" {
+		return nil
+	}
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+	maxAge := parseSeconds(cc["max-age"])
+	if s, ok := cc["s-maxage"]; ok {
+		maxAge = parseSeconds(s)
+	}
+	if maxAge == 0 {
+		return nil
+	}
+	return &CacheEntry{
+		StatusCode:           statusCode,
+		Header:               header.Clone(),
+		Body:                 body,
+		Stored:               now,
+		MaxAge:               maxAge,
+		StaleWhileRevalidate: parseSeconds(cc["stale-while-revalidate"]),
+		StaleIfError:         parseSeconds(cc["stale-if-error"]),
+	}
+}
+
+func (e *CacheEntry) serve(w http.ResponseWriter, state string, now time.Time) {
+	for key, values := range e.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.Stored)/time.Second)))
+	w.Header().Set(CacheHeader, state)
+	w.WriteHeader(e.StatusCode)
+	w.Write(e.Body)
+}
+
+// recordingWriter keeps copy of the response to store it in the cache.
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	limit      uint64 // max body size to record
+	overflow   bool
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 && statusCode >= 200 {
+		w.statusCode = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if uint64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withCache serves cached GET responses and stores responses from the server process.
+func withCache(next http.Handler, process ProcessController, opt ProxyOption) http.Handler {
+	if opt.Cache == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cc := parseCacheControl(r.Header.Get("Cache-Control"))
+		_, noCache := cc["no-cache"]
+		_, noStore := cc["no-store"]
+		key := cacheKey(opt.CacheScope, r)
+		now := opt.Cache.clock.Now()
+		if entry := opt.Cache.get(key); entry != nil && !noCache {
+			if entry.fresh(now) {
+				entry.serve(w, "HIT", now)
+				return
+			} else if processStatus(process) == Drained && entry.staleAllowed(now, opt.Cache.maxStale) {
+				entry.serve(w, "STALE", now)
+				return
+			}
+		}
+		if noStore {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &recordingWriter{ResponseWriter: w, limit: opt.Cache.maxBodySize}
+		next.ServeHTTP(rw, r)
+		if rw.overflow || rw.statusCode == 0 || rw.header.Get(ErrorKindHeader) != "" {
+			return
+		}
+		if entry := newCacheEntry(rw.statusCode, rw.header, rw.body.Bytes(), now); entry != nil {
+			opt.Cache.put(key, entry)
+		}
+	})
+}
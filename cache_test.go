@@ -0,0 +1,194 @@
+package saving
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+func TestCacheEntry(t *testing.T) {
+	now := time.Now()
+	header := func(cc string) http.Header {
+		h := http.Header{}
+		h.Set("Cache-Control", cc)
+		return h
+	}
+	assert.Zero(t, newCacheEntry(http.StatusOK, header("no-store"), nil, now))
+	assert.Zero(t, newCacheEntry(http.StatusOK, header("private, max-age=60"), nil, now))
+	assert.Zero(t, newCacheEntry(http.StatusOK, header(""), nil, now))
+	assert.Zero(t, newCacheEntry(http.StatusInternalServerError, header("max-age=60"), nil, now))
+
+	entry := newCacheEntry(http.StatusOK, header("public, max-age=60, stale-while-revalidate=60"), nil, now)
+	assert.NotZero(t, entry)
+	assert.True(t, entry.fresh(now.Add(59*time.Second)))
+	assert.False(t, entry.fresh(now.Add(61*time.Second)))
+	assert.True(t, entry.staleAllowed(now.Add(119*time.Second), 0))
+	assert.False(t, entry.staleAllowed(now.Add(121*time.Second), 0))
+	assert.True(t, entry.staleAllowed(now.Add(121*time.Second), time.Hour))
+
+	shared := newCacheEntry(http.StatusOK, header("max-age=0, s-maxage=30"), nil, now)
+	assert.Equal(t, 30*time.Second, shared.MaxAge)
+}
+
+func TestCacheWhileSleeping(t *testing.T) {
+	cache, err := NewResponseCache(CacheOption{})
+	assert.NoError(t, err)
+	process := &stubProcess{status: Waked}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		process.Exec(func() {})
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("hello from " + r.URL.Path))
+	})
+	handler := withCache(next, process, ProxyOption{Cache: cache})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// awake: responses are stored
+	assert.Equal(t, "", get("/cached").Header().Get(CacheHeader))
+	get("/uncached")
+	assert.Equal(t, 1, cache.Len())
+	assert.Equal(t, int32(2), process.execs.Load())
+
+	// asleep: hit doesn't wake the process, miss does
+	process.status = Drained
+	w := get("/cached")
+	assert.Equal(t, "HIT", w.Header().Get(CacheHeader))
+	assert.Equal(t, "hello from /cached", w.Body.String())
+	assert.Equal(t, int32(2), process.execs.Load())
+	get("/uncached")
+	assert.Equal(t, int32(3), process.execs.Load())
+}
+
+func TestCacheStaleAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewResponseCache(CacheOption{Path: path, MaxStale: time.Minute})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/stale", nil)
+	h := http.Header{}
+	h.Set("Cache-Control", "max-age=1")
+	cache.put(cacheKey("", r), newCacheEntry(http.StatusOK, h, []byte("stale"), time.Now().Add(-10*time.Second)))
+	assert.NoError(t, cache.Save())
+
+	restored, err := NewResponseCache(CacheOption{Path: path, MaxStale: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored.Len())
+
+	process := &stubProcess{status: Drained}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		process.Exec(func() {})
+		w.Write([]byte("fresh"))
+	})
+	handler := withCache(next, process, ProxyOption{Cache: restored})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "STALE", w.Header().Get(CacheHeader))
+	assert.Equal(t, "stale", w.Body.String())
+
+	// stale entries are not served while awake
+	process.status = Waked
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "fresh", w.Body.String())
+}
+
+func TestCacheScope(t *testing.T) {
+	cache, err := NewResponseCache(CacheOption{})
+	assert.NoError(t, err)
+	process := &stubProcess{status: Waked}
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(body))
+		})
+	}
+	// two ports share the cache like StartProxy
+	api := withCache(handler("api"), process, ProxyOption{Cache: cache, CacheScope: "http://localhost:8000"})
+	admin := withCache(handler("admin"), process, ProxyOption{Cache: cache, CacheScope: "http://localhost:9000"})
+
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Body.String()
+	}
+	assert.Equal(t, "api", get(api))
+	assert.Equal(t, "admin", get(admin))
+	assert.Equal(t, "api", get(api))
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestCacheSaver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewResponseCache(CacheOption{Path: path})
+	assert.NoError(t, err)
+	clk := clocktest.NewFake(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startCacheSaver(ctx, cache, time.Minute, clk, slog.Default())
+	clk.BlockUntil(1)
+
+	h := http.Header{}
+	h.Set("Cache-Control", "max-age=60")
+	cache.put("key", newCacheEntry(http.StatusOK, h, []byte("body"), time.Now()))
+	clk.Advance(time.Minute)
+	// the file is saved without shutdown
+	deadline := time.Now().Add(time.Second)
+	for {
+		restored, err := NewResponseCache(CacheOption{Path: path})
+		if err == nil && restored.Len() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache is not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	cache, err := NewResponseCache(CacheOption{MaxSize: 10, MaxBodySize: 6, Clock: clk})
+	assert.NoError(t, err)
+	process := &stubProcess{status: Waked}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Query().Get("body")))
+	})
+	handler := withCache(next, process, ProxyOption{Cache: cache})
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Header().Get(CacheHeader)
+	}
+
+	get("/?body=1234")
+	clk.Advance(time.Second)
+	get("/?body=5678")
+	assert.Equal(t, 2, cache.Len())
+	// too large body is not stored
+	get("/?body=1234567")
+	assert.Equal(t, 2, cache.Len())
+	// the oldest entry is evicted to keep total size
+	clk.Advance(time.Second)
+	get("/?body=abcd")
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, "", get("/?body=1234"))
+	assert.Equal(t, "HIT", get("/?body=abcd"))
+
+	// the age follows the clock
+	clk.Advance(time.Minute)
+	assert.Equal(t, "", get("/?body=abcd"))
+}
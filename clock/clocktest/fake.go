@@ -0,0 +1,163 @@
+// Package clocktest provides a fake clock.Clock for tests.
+package clocktest
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// Fake is a clock.Clock that moves only by Advance.
+//
+// Timers fire during Advance in order of their deadlines. Unlike the time package, AfterFunc
+// callbacks run synchronously in Advance, so their effects are visible when Advance returns.
+type Fake struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+var _ clock.Clock = (*Fake)(nil)
+
+// NewFake creates Fake that starts at start.
+func NewFake(start time.Time) *Fake {
+	result := &Fake{now: start}
+	result.cond = sync.NewCond(&result.lock)
+	return result
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) clock.Timer {
+	t := &fakeTimer{fake: f, fn: fn}
+	t.Reset(d)
+	return t
+}
+
+func (f *Fake) NewTimer(d time.Duration) clock.Timer {
+	t := &fakeTimer{fake: f, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (f *Fake) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{fake: f, ch: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return fakeTicker{t}
+}
+
+// Advance moves the clock forward by d and fires timers whose deadlines pass.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	target := f.now.Add(d)
+	for {
+		next := f.nextLocked(target)
+		if next == nil {
+			break
+		}
+		f.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			f.removeLocked(next)
+		}
+		now := f.now
+		if next.fn != nil {
+			f.lock.Unlock()
+			next.fn()
+			f.lock.Lock()
+		} else {
+			select {
+			case next.ch <- now:
+			default: // like time.Ticker, drop ticks for slow receivers
+			}
+		}
+	}
+	f.now = target
+	f.lock.Unlock()
+}
+
+// BlockUntil waits until n timers and tickers are active. It helps to wait for goroutines
+// under test to arm their timers before Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// Waiters returns count of active timers and tickers.
+func (f *Fake) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.waiters)
+}
+
+func (f *Fake) nextLocked(target time.Time) *fakeTimer {
+	var result *fakeTimer
+	for _, t := range f.waiters {
+		if !t.when.After(target) && (result == nil || t.when.Before(result.when)) {
+			result = t
+		}
+	}
+	return result
+}
+
+func (f *Fake) removeLocked(t *fakeTimer) bool {
+	i := slices.Index(f.waiters, t)
+	if i < 0 {
+		return false
+	}
+	f.waiters = slices.Delete(f.waiters, i, i+1)
+	return true
+}
+
+type fakeTimer struct {
+	fake   *Fake
+	when   time.Time
+	fn     func()
+	ch     chan time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.lock.Lock()
+	defer t.fake.lock.Unlock()
+	return t.fake.removeLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.fake.lock.Lock()
+	defer t.fake.lock.Unlock()
+	active := t.fake.removeLocked(t)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.when = t.fake.now.Add(d)
+	t.fake.waiters = append(t.fake.waiters, t)
+	t.fake.cond.Broadcast()
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
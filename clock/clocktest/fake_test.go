@@ -0,0 +1,47 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+	var fired []string
+	clk.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	clk.AfterFunc(time.Second, func() {
+		fired = append(fired, "a")
+		assert.Equal(t, start.Add(time.Second), clk.Now())
+	})
+	stopped := clk.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	assert.True(t, stopped.Stop())
+	assert.Equal(t, 2, clk.Waiters())
+
+	clk.Advance(1500 * time.Millisecond)
+	assert.Equal(t, []string{"a"}, fired)
+	clk.Advance(time.Second)
+	assert.Equal(t, []string{"a", "b"}, fired)
+	assert.Equal(t, start.Add(2500*time.Millisecond), clk.Now())
+}
+
+func TestFakeTicker(t *testing.T) {
+	clk := NewFake(time.Unix(0, 0))
+	ticker := clk.NewTicker(time.Second)
+	defer ticker.Stop()
+	clk.Advance(time.Second)
+	assert.Equal(t, time.Unix(1, 0), <-ticker.C())
+	clk.Advance(3 * time.Second) // slow receiver drops ticks
+	assert.Equal(t, time.Unix(2, 0), <-ticker.C())
+	select {
+	case <-ticker.C():
+		t.Fatal("dropped tick is received")
+	default:
+	}
+
+	timer := clk.NewTimer(time.Second)
+	go clk.Advance(time.Second)
+	<-timer.C()
+}
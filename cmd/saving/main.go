@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -18,11 +19,58 @@ import (
 var (
 	helps = []string{
 		`SAVING_PORT_MAPS             : (required)It is a port mapping settings like 80:8000. Comma separated.`,
+		`                               Upstream can be URL like 80:https://localhost:8443, 80:h2c://localhost:50051 or 80:unix:/run/app.sock`,
+		`                               tcp:// upstream like 5432:tcp://localhost:5433 relays raw TCP`,
+		`                               udp:// upstream like 53:udp://localhost:5353 relays UDP datagrams`,
+		`                               Listening side can be unix socket like unix:/run/saving.sock:8000`,
+		`SAVING_UPSTREAM_CA_FILE      : CA certificates to verify https upstreams (default='', system roots)`,
+		`SAVING_UPSTREAM_INSECURE_SKIP_VERIFY: Don't verify certificates of https upstreams (default=no)`,
 		`SAVING_DRAIN_TIMEOUT         : Timeout duration after last request to scale in (default=1m)`,
+		`SAVING_DRAIN_POLICY          : 'fixed' or 'adaptive'. 'adaptive' learns request intervals and picks drain timeout (default=fixed)`,
+		`SAVING_DRAIN_TIMEOUT_MIN     : Lower bound of adaptive drain timeout (default=10s)`,
+		`SAVING_DRAIN_TIMEOUT_MAX     : Upper bound of adaptive drain timeout (default=10m)`,
+		`SAVING_AWAKE_SCHEDULE        : Cron style schedules to keep the process awake like '0-59 9-17 * * 1-5'. Semicolon separated (default='')`,
+		`SAVING_PRE_WAKE              : Wake the process this duration before the schedule starts (default=0s)`,
+		`SAVING_SLEEP_OUTSIDE_SCHEDULE: Sleep the process as soon as the schedule ends (default=no)`,
+		`SAVING_MAX_AWAKE             : Recycle the process after this awake duration (default=0s, disabled)`,
+		`SAVING_MAX_REQUESTS          : Recycle the process after this count of requests (default=0, disabled)`,
+		`SAVING_MEMORY_LIMIT          : Sleep the process early when its RSS exceeds this size like 512Mi (default='')`,
+		`SAVING_MEMORY_PRESSURE       : Sleep the process early when memory pressure (PSI some avg10) exceeds this percent (default='')`,
+		`SAVING_MAX_QUEUED            : Max count of requests waiting for wake. Requests over it get 503 (default=0, unlimited)`,
+		`SAVING_MAX_QUEUE_WAIT        : Max duration requests wait for wake. Requests over it get 503 (default=0s, unlimited)`,
+		`SAVING_CANCEL_ABANDONED_WAKE : Stop waking the process when all clients waiting for it disconnect (default=no)`,
+		`SAVING_TLS_PORTS             : Comma separated listening ports that terminate TLS (default='')`,
+		`SAVING_TLS_CERT_FILE         : Comma separated certificate files. The certificate is selected by SNI and reloaded when modified`,
+		`SAVING_TLS_KEY_FILE          : Comma separated key files paired with SAVING_TLS_CERT_FILE`,
+		`SAVING_TLS_CLIENT_CA_FILE    : CA certificates to verify client certificates (mTLS) (default='', disabled)`,
+		`SAVING_GRPC_PORTS            : Comma separated listening ports that accept gRPC (h2c). Their upstreams should be h2c:// or https:// (default='')`,
+		`SAVING_UDP_FLOW_TIMEOUT      : Duration to keep the flow of each UDP client without datagrams (default=30s)`,
+		`SAVING_UDP_MAX_FLOWS         : Max count of UDP flows of each port. Datagrams of new clients over it are dropped (default=1024)`,
+		`SAVING_UNIX_SOCKET_MODE      : Octal permission of listening unix sockets like 0660 (default='', umask)`,
+		`SAVING_PROXY_PROTOCOL_PORTS  : Comma separated listening ports that read PROXY protocol v1/v2 header (default='')`,
+		`SAVING_PROXY_PROTOCOL_TRUSTED: Comma separated CIDRs of load balancers that send PROXY protocol header (default='', any)`,
+		`SAVING_PROXY_PROTOCOL_UPSTREAM: Send PROXY protocol header to tcp:// upstreams, v1 or v2 (default='', not sent)`,
 		`SAVING_WAKE_TIMEOUT          : Timeout duration when the process is ready after initial request (default=10s)`,
 		`SAVING_PID_PATH              : PID file location (default=$TMP/SAVING_PID)`,
+		`SAVING_STATE_PATH            : State file location (default=$TMP/SAVING_STATE.json)`,
 		`SAVING_HEALTH_CHECK_PORT     : Health check port (default=initial target port of SAVING_PORT_MAPS)`,
 		`SAVING_HEALTH_CHECK_PATH     : Health check path (default=/health)`,
+		`SAVING_LIVENESS_PATH         : Path of built-in liveness endpoint on listening ports. It doesn't wake the process (default='')`,
+		`SAVING_READINESS_PATH        : Path of built-in readiness endpoint on listening ports. It doesn't wake the process (default='')`,
+		`SAVING_WAITING_PAGE          : Return waiting page to browsers while the process is waking. 'default' or HTML template file path (default='')`,
+		`SAVING_RETRY_AFTER           : Return 503 with Retry-After to API clients while the process is waking. It is also refresh interval of waiting page (default='')`,
+		`SAVING_ERROR_PAGE            : HTML template file of error page when the process can't wake or respond (default=built-in page)`,
+		`SAVING_ERROR_JSON            : JSON template file of error body when the process can't wake or respond (default=built-in body)`,
+		`SAVING_EXEMPT_RULES          : Rules for requests answered without waking the process like 'path=/favicon.ico,status=204;ua=^kube-probe/,body=ok' (default='')`,
+		`SAVING_CACHE                 : Cache GET responses that Cache-Control allows and serve them without waking the process (default=no)`,
+		`SAVING_CACHE_MAX_STALE       : Serve stale cached responses within this duration while the process is sleeping (default=0s)`,
+		`SAVING_CACHE_PATH            : File to persist cached responses across restarts (default='')`,
+		`SAVING_CACHE_SIZE            : Total body size of cached responses like 64Mi (default=32Mi)`,
+		`SAVING_CACHE_MAX_BODY_SIZE   : Max body size of each cached response like 1Mi (default=256Ki)`,
+		`SAVING_STATIC_DIR            : Directory of static files served without waking the process (default='')`,
+		`SAVING_WAKE_LIMIT            : Count of wakes each source address can trigger per duration like 3/1h (default='')`,
+		`SAVING_WAKE_ALLOW            : Comma separated CIDRs that can wake the process (default='', any sources)`,
+		`SAVING_WAKE_DENY             : Comma separated CIDRs that can't wake the process (default='')`,
 		``,
 		`SAVING_SLOG_FORMAT           : Log format. 'text' or 'json' is acceptable (default=text)`,
 		`SAVING_SLOG_ADD_SOURCE       : Add source location to log (default=no)`,
@@ -44,6 +92,9 @@ func main() {
 	help := flag.Bool("help", false, "Help")
 	verbose := flag.Bool("verbose", false, "Put many logs")
 	healthCheck := flag.Bool("health-check", false, "health check")
+	liveness := flag.Bool("liveness", false, "liveness check: saving process is running")
+	readiness := flag.Bool("readiness", false, "readiness check: saving process can serve requests (possibly after waking)")
+	savings := flag.Bool("savings", false, "print the state file including cumulative savings as JSON")
 	flag.Parse()
 
 	if *help {
@@ -75,21 +126,102 @@ func main() {
 	}
 	opt.Logger = logger
 
-	if *healthCheck {
-		result := saving.CheckProcessHealth(opt.PidPath)
-		logger.Info("health check", "result", result)
+	if *healthCheck || *liveness || *readiness {
+		var result bool
+		var name string
+		switch {
+		case *liveness:
+			result = saving.CheckProcessLiveness(opt.PidPath)
+			name = "liveness check"
+		case *readiness:
+			result = saving.CheckProcessReadiness(opt.PidPath, opt.HealthCheckTransport)
+			name = "readiness check"
+		default:
+			result = saving.CheckProcessHealth(opt.PidPath, opt.HealthCheckTransport)
+			name = "health check"
+		}
+		logger.Info(name, "result", result)
 		if result {
 			os.Exit(0)
 		} else {
 			os.Exit(1)
 		}
+	} else if *savings {
+		state, err := saving.ReadState(opt.StatePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "state file error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(state)
 	} else if flag.NArg() > 0 {
 		attrs := []any{
 			slog.String("cmd", strings.TrimSpace(opt.Cmd+" "+strings.Join(opt.Args, " "))),
 			slog.String("health_check_url", opt.HealthCheckUrl.String()),
 			slog.Duration("drain_timeout", opt.DrainTimeout),
+			slog.String("drain_policy", opt.DrainPolicy),
 			slog.Duration("wake_timeout", opt.WakeTimeout),
 			slog.String("pid_path", opt.PidPath),
+			slog.String("state_path", opt.StatePath),
+		}
+		for _, s := range opt.AwakeSchedules {
+			attrs = append(attrs, slog.String("awake_schedule", s.String()))
+		}
+		if len(opt.AwakeSchedules) > 0 {
+			attrs = append(attrs, slog.Duration("pre_wake", opt.PreWake), slog.Bool("sleep_outside_schedule", opt.SleepOutside))
+		}
+		if opt.MaxAwake > 0 {
+			attrs = append(attrs, slog.Duration("max_awake", opt.MaxAwake))
+		}
+		if opt.MaxRequests > 0 {
+			attrs = append(attrs, slog.Uint64("max_requests", opt.MaxRequests))
+		}
+		if opt.MemoryLimit > 0 {
+			attrs = append(attrs, slog.Uint64("memory_limit", opt.MemoryLimit))
+		}
+		if opt.MemoryPressure > 0 {
+			attrs = append(attrs, slog.Float64("memory_pressure", opt.MemoryPressure))
+		}
+		if opt.MaxQueued > 0 {
+			attrs = append(attrs, slog.Int("max_queued", opt.MaxQueued))
+		}
+		if opt.MaxQueueWait > 0 {
+			attrs = append(attrs, slog.Duration("max_queue_wait", opt.MaxQueueWait))
+		}
+		if opt.CancelAbandonedWake {
+			attrs = append(attrs, slog.Bool("cancel_abandoned_wake", true))
+		}
+		if opt.LivenessPath != "" {
+			attrs = append(attrs, slog.String("liveness_path", opt.LivenessPath))
+		}
+		if opt.ReadinessPath != "" {
+			attrs = append(attrs, slog.String("readiness_path", opt.ReadinessPath))
+		}
+		if opt.WaitingPage != nil {
+			attrs = append(attrs, slog.Bool("waiting_page", true))
+		}
+		if opt.RetryAfter != 0 {
+			attrs = append(attrs, slog.Duration("retry_after", opt.RetryAfter))
+		}
+		if opt.Cache {
+			attrs = append(attrs, slog.Bool("cache", true), slog.Duration("cache_max_stale", opt.CacheMaxStale))
+			if opt.CacheSize != 0 {
+				attrs = append(attrs, slog.Uint64("cache_size", opt.CacheSize))
+			}
+			if opt.CacheMaxBodySize != 0 {
+				attrs = append(attrs, slog.Uint64("cache_max_body_size", opt.CacheMaxBodySize))
+			}
+			if opt.CachePath != "" {
+				attrs = append(attrs, slog.String("cache_path", opt.CachePath))
+			}
+		}
+		if opt.StaticDir != "" {
+			attrs = append(attrs, slog.String("static_dir", opt.StaticDir))
+		}
+		if opt.WakeLimitBurst > 0 {
+			attrs = append(attrs, slog.String("wake_limit", fmt.Sprintf("%d/%s", opt.WakeLimitBurst, opt.WakeLimitPer)))
+		}
+		if len(opt.ExemptRules) > 0 {
+			attrs = append(attrs, slog.Int("exempt_rules", len(opt.ExemptRules)))
 		}
 		if runtime.GOOS == "linux" {
 			attrs = append(attrs, slog.Bool("use_criu", opt.CriuPath != ""))
@@ -98,14 +230,28 @@ func main() {
 				attrs = append(attrs, slog.String("criu_dump_path", opt.CriuDumpPath))
 			}
 		}
-		ports := make([]any, len(opt.PortMaps)*2)
+		if len(opt.TLS.CertFiles) > 0 {
+			attrs = append(attrs, slog.Any("tls_cert_files", opt.TLS.CertFiles))
+			attrs = append(attrs, slog.Bool("tls_client_auth", opt.TLS.ClientCAFile != ""))
+		}
+		if opt.Upstream.InsecureSkipVerify {
+			attrs = append(attrs, slog.Bool("upstream_insecure_skip_verify", true))
+		}
+		if slices.ContainsFunc(opt.PortMaps, func(p saving.PortMap) bool { return p.Destination.Scheme == "udp" }) {
+			attrs = append(attrs, slog.Duration("udp_flow_timeout", opt.UDPFlowTimeout))
+			attrs = append(attrs, slog.Int("udp_max_flows", opt.UDPMaxFlows))
+		}
+		ports := make([]any, len(opt.PortMaps)*5)
 		for i, p := range opt.PortMaps {
-			ports[i*2] = slog.String("from", p.FromPort)
-			ports[i*2+1] = slog.String("dest", p.Destination.String())
+			ports[i*5] = slog.String("from", p.FromPort)
+			ports[i*5+1] = slog.String("dest", p.Destination.String())
+			ports[i*5+2] = slog.Bool("tls", p.TLS)
+			ports[i*5+3] = slog.Bool("grpc", p.GRPC)
+			ports[i*5+4] = slog.Bool("proxy_protocol", p.ProxyProtocol)
 		}
 		if logType == sloginit.JsonLog {
 			group := []any{}
-			for portMap := range slices.Chunk(ports, 2) {
+			for portMap := range slices.Chunk(ports, 5) {
 				group = append(group, slog.Group("port_map", portMap...))
 			}
 			attrs = append(attrs, group)
@@ -114,7 +260,7 @@ func main() {
 			for _, attr := range attrs {
 				logger.Info("config", attr)
 			}
-			for portMap := range slices.Chunk(ports, 2) {
+			for portMap := range slices.Chunk(ports, 5) {
 				logger.Info("config", portMap...)
 			}
 		}
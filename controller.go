@@ -1,6 +1,8 @@
 package saving
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"net/url"
 	"os"
@@ -15,6 +17,45 @@ type ProcessController interface {
 	Pid() int
 }
 
+// StatusReporter is an optional interface of ProcessController that reports its Status.
+// Built-in controllers implement it.
+type StatusReporter interface {
+	Status() Status
+}
+
+// ContextExecutor is an optional interface of ProcessController that stops waiting for wake
+// when ctx is canceled. Built-in controllers implement it.
+type ContextExecutor interface {
+	ExecContext(ctx context.Context, callback func()) error
+}
+
+// processStatus returns Status of process. Controllers without StatusReporter are
+// Waking while IsWaking, Waked while they have pid, and Drained otherwise.
+func processStatus(process ProcessController) Status {
+	if r, ok := process.(StatusReporter); ok {
+		return r.Status()
+	}
+	switch {
+	case process.IsWaking():
+		return Waking
+	case process.Pid() != 0:
+		return Waked
+	default:
+		return Drained
+	}
+}
+
+// execContext calls ExecContext of process, or Exec if process doesn't implement ContextExecutor.
+func execContext(ctx context.Context, process ProcessController, callback func()) error {
+	if e, ok := process.(ContextExecutor); ok {
+		return e.ExecContext(ctx, callback)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return process.Exec(callback)
+}
+
 func writePid(pidPath string, healthCheckUrl *url.URL) error {
 	os.Remove(pidPath)
 	f, err := os.Create(pidPath)
@@ -29,3 +70,24 @@ func writePid(pidPath string, healthCheckUrl *url.URL) error {
 	}
 	return nil
 }
+
+// readPid reads the file written by writePid.
+// healthCheckUrl is nil when the server process is sleeping.
+func readPid(pidPath string) (pid int, healthCheckUrl *url.URL, err error) {
+	content, err := os.ReadFile(pidPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	chunks := bytes.SplitN(content, []byte{':'}, 2)
+	pid, err = strconv.Atoi(string(bytes.TrimSpace(chunks[0])))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(chunks) == 2 {
+		healthCheckUrl, err = url.Parse(string(chunks[1]))
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return pid, healthCheckUrl, nil
+}
@@ -7,11 +7,14 @@ import (
 	"os/exec"
 	"strconv"
 	"sync/atomic"
-	"time"
+
+	"github.com/shibukawa/saving/clock"
 )
 
 type CriuProcessController struct {
 	drainable *Drainable
+	state     *stateRecorder
+	savings   *savingsTracker
 	access    uint64
 	pid       int
 	ProcessOption
@@ -19,7 +22,12 @@ type CriuProcessController struct {
 
 // IsWaking implements ProcessController.
 func (c *CriuProcessController) IsWaking() bool {
-	panic("unimplemented")
+	return c.drainable.IsWaking()
+}
+
+// Status implements ProcessController.
+func (c *CriuProcessController) Status() Status {
+	return c.drainable.Status()
 }
 
 // Pid implements ProcessController.
@@ -27,7 +35,11 @@ func (c *CriuProcessController) Pid() int {
 	return c.pid
 }
 
-var _ ProcessController = (*CriuProcessController)(nil)
+var (
+	_ ProcessController = (*CriuProcessController)(nil)
+	_ StatusReporter    = (*CriuProcessController)(nil)
+	_ ContextExecutor   = (*CriuProcessController)(nil)
+)
 
 func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProcessController, error) {
 	err := writePid(opt.PidPath, nil)
@@ -35,9 +47,14 @@ func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProc
 		return nil, err
 	}
 	os.MkdirAll(opt.CriuDumpPath, 0o666)
+	if opt.Logger == nil {
+		opt.Logger = slog.Default()
+	}
+	opt.Clock = clock.OrReal(opt.Clock)
 
 	result := &CriuProcessController{
 		ProcessOption: opt,
+		state:         newStateRecorder(opt.StatePath),
 	}
 
 	drainable := NewDrainable(
@@ -45,13 +62,28 @@ func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProc
 		result.stop,
 		opt.DrainTimeout,
 		func(s Status) {
+			result.state.update(func(state *State) {
+				state.Status = s.GoString()
+			})
 			switch s {
+			case Waked:
+				result.state.recordQueue(result.drainable, opt.Logger)
 			case Failed:
+				result.state.recordQueue(result.drainable, opt.Logger)
 				os.Remove(opt.PidPath)
 			}
 		},
 	)
+	policy, err := NewDrainPolicy(opt.DrainPolicy, opt.DrainTimeout, opt.DrainTimeoutMin, opt.DrainTimeoutMax)
+	if err != nil {
+		return nil, err
+	}
+	drainable.SetDrainPolicy(policy)
+	drainable.SetClock(opt.Clock)
+	drainable.SetQueueLimit(opt.MaxQueued, opt.MaxQueueWait)
+	opt.WakeLimiter.recordState(result.state)
 	result.drainable = drainable
+	result.savings = newSavingsTracker(result.state, opt.Clock.Now(), opt.Logger)
 
 	// exec process
 	cmd := exec.Command(opt.Cmd, opt.Args...)
@@ -63,7 +95,7 @@ func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProc
 	}
 	result.pid = cmd.Process.Pid
 	opt.Logger.Info("process start", "pid", result.pid)
-	status := WaitAndCheckHealth(result.WakeTimeout, result.HealthCheckUrl)
+	status := waitAndCheckHealth(ctx, result.Clock, healthCheckClient(result.HealthCheckTransport), result.WakeTimeout, result.HealthCheckUrl)
 	if !status {
 		return nil, ErrHealthCheckFailed
 	}
@@ -72,11 +104,15 @@ func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProc
 		return nil, err
 	}
 
+	startScheduler(ctx, drainable, opt.AwakeSchedules, opt.PreWake, opt.SleepOutside, opt.Clock, opt.Logger)
+	startMemoryWatcher(ctx, drainable, result.Pid, opt.MemoryLimit, opt.MemoryPressure, result.state, opt.Clock, opt.Logger)
+
 	// force stop process when context is done
 	go func() {
 		<-ctx.Done()
 		result.stop()
 		os.Remove(opt.PidPath)
+		result.state.remove()
 	}()
 
 	return result, nil
@@ -84,35 +120,45 @@ func NewCriuProcessController(ctx context.Context, opt ProcessOption) (*CriuProc
 
 // Exec implements ProcessController.
 func (c *CriuProcessController) Exec(callback func()) error {
+	return c.ExecContext(context.Background(), callback)
+}
+
+// ExecContext implements ContextExecutor.
+//
+// Wake by criu restore is not canceled even if SetCancelAbandonedWake is enabled.
+func (c *CriuProcessController) ExecContext(ctx context.Context, callback func()) error {
 	atomic.AddUint64(&c.access, 1)
-	return c.drainable.Exec(callback)
+	return c.drainable.ExecContext(ctx, callback)
 }
 
 func (c *CriuProcessController) start() error {
 	atomic.StoreUint64(&c.access, 0)
-	start := time.Now()
+	start := c.Clock.Now()
 	cmd := exec.Command(c.CriuPath, "restore", "-D", c.CriuDumpPath)
 	result, err := cmd.CombinedOutput()
 	if err != nil {
 		return err
 	}
-	c.Logger.Info("process start by criu", slog.Duration("boot_time", time.Now().Sub(start)))
+	c.Logger.Info("process start by criu", slog.Duration("boot_time", c.Clock.Now().Sub(start)))
 	c.Logger.Info(string(result))
 	/*status := WaitAndCheckHealth(c.WakeTimeout, c.HealthCheckUrl)
 	if !status {
 		return ErrHealthCheckFailed
 	}*/
+	c.savings.woke(c.Clock.Now())
 	return writePid(c.PidPath, c.HealthCheckUrl)
 }
 
 func (c *CriuProcessController) stop() error {
 	c.Logger.Info("process stop", "pid", c.pid, "access", c.access)
 	writePid(c.PidPath, nil)
+	usage := usageFromProc(c.pid)
 	cmd := exec.Command(c.CriuPath, "dump", "--shell-job", "-t", strconv.Itoa(c.pid), "-D", c.CriuDumpPath)
 	result, err := cmd.CombinedOutput()
 	c.Logger.Info(string(result))
 	if err != nil {
 		return err
 	}
+	c.savings.slept(c.Clock.Now(), usage)
 	return nil
 }
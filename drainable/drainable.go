@@ -0,0 +1,567 @@
+// Package drainable runs jobs against a lazy resource: it boots the resource on the first job
+// and closes it after an idle timeout.
+//
+// saving uses it for the server process, but it works for any resource that is expensive
+// to keep, like database connections or in-process caches.
+package drainable
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+var (
+	ErrQueueFull    = errors.New("wait queue is full")
+	ErrQueueTimeout = errors.New("wait queue timeout")
+)
+
+type Status int
+
+const (
+	Drained    Status = iota + 1 // The resource is closed. The next job boots it
+	Waking                       // The resource is booting
+	Waked                        // The resource is ready and jobs run
+	Failed                       // Boot or close failed. Jobs fail with the error
+	Draining                     // The resource is closing after idle timeout
+	Rebooting                    // Jobs came while closing. It boots again after closing
+	Terminated                   // Terminate is called. Jobs do nothing
+)
+
+func (s Status) String() string {
+	switch s {
+	case Drained:
+		return "Drained"
+	case Waking:
+		return "Waking"
+	case Waked:
+		return "Waked"
+	case Failed:
+		return "Failed"
+	case Draining:
+		return "Draining"
+	case Rebooting:
+		return "Rebooting"
+	case Terminated:
+		return "Terminated"
+	default:
+		return "unknown"
+	}
+}
+
+func (s Status) GoString() string {
+	return s.String()
+}
+
+// Transition is a status change of Drainable.
+type Transition struct {
+	From Status
+	To   Status
+	At   time.Time
+	Err  error // Error of boot or close that caused the transition
+}
+
+// TransitionLogSize is count of transitions Drainable keeps for Transitions.
+const TransitionLogSize = 32
+
+// Drainable boots the resource on demand, and closes it when no jobs run during drain timeout.
+//
+//	Drained ──job──▶ Waking ──ok──▶ Waked ──idle──▶ Draining ──ok──▶ Drained
+//	                    └──error──▶ Failed ◀──error───┘
+//	Draining ──job──▶ Rebooting ──ok──▶ Waked
+//
+// All status changes happen under one lock, and one idle timer is reset by jobs.
+type Drainable struct {
+	bootService  func(ctx context.Context) error
+	closeService func() error
+	policy       DrainPolicy
+	status       Status
+	wait         chan struct{} // closed and replaced on each status change
+	lock         sync.Mutex
+	inFlight     int
+	clock        clock.Clock
+	timer        clock.Timer
+	idle         bool      // timer is armed
+	deadline     time.Time // time to drain while idle
+	sleep        bool      // Sleep is requested
+	graceful     bool      // jobs still run on the service during grace of SleepWithin
+	graceTimer   clock.Timer
+	unhold       chan struct{} // closed to move holds to the next service when grace ends
+	reboot       bool          // jobs came after Sleep request
+	queued       int           // jobs waiting for wake under queue limits
+	waiters      int           // all jobs waiting for wake including the job that started it
+	peakQueued   int           // max of queued since the last wake started
+	rejected     uint64
+	maxQueued    int
+	maxWait      time.Duration
+	cancelWake   context.CancelFunc
+	cancelIdle   bool // cancel the wake when no jobs wait for it
+	error        error
+	callback     func(s Status)
+	onTransition func(t Transition)
+	transitions  []Transition
+}
+
+// New creates Drainable. callback is called after boot or close finishes.
+func New(bootService, closeService func() error, drainTimeout time.Duration, callback func(s Status)) *Drainable {
+	return NewContext(func(ctx context.Context) error {
+		return bootService()
+	}, closeService, drainTimeout, callback)
+}
+
+// NewContext is New with bootService that can be canceled.
+//
+// The context passed to bootService is canceled when all jobs waiting for the wake are gone
+// and SetCancelAbandonedWake(true) is called.
+func NewContext(bootService func(ctx context.Context) error, closeService func() error, drainTimeout time.Duration, callback func(s Status)) *Drainable {
+	result := &Drainable{
+		bootService:  bootService,
+		closeService: closeService,
+		policy:       FixedDrainPolicy(drainTimeout),
+		status:       Drained,
+		wait:         make(chan struct{}),
+		unhold:       make(chan struct{}),
+		callback:     callback,
+		clock:        clock.Real,
+	}
+	result.timer = result.clock.AfterFunc(time.Hour, result.timeout)
+	result.timer.Stop()
+	return result
+}
+
+// SetClock replaces the clock of timers. It should be called before the first job.
+func (d *Drainable) SetClock(c clock.Clock) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.timer.Stop()
+	d.clock = c
+	d.timer = c.AfterFunc(time.Hour, d.timeout)
+	d.timer.Stop()
+}
+
+// SetDrainPolicy replaces fixed drain timeout passed to New.
+func (d *Drainable) SetDrainPolicy(policy DrainPolicy) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.policy = policy
+}
+
+// SetQueueLimit limits jobs waiting for wake. Jobs over maxQueued fail with ErrQueueFull,
+// and jobs waiting longer than maxWait fail with ErrQueueTimeout. Zero means unlimited.
+func (d *Drainable) SetQueueLimit(maxQueued int, maxWait time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.maxQueued = maxQueued
+	d.maxWait = maxWait
+}
+
+// SetCancelAbandonedWake enables canceling the wake when all jobs waiting for it are canceled.
+func (d *Drainable) SetCancelAbandonedWake(cancel bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.cancelIdle = cancel
+}
+
+// OnTransition sets observer of all status changes.
+//
+// It is called with the internal lock in order of transitions, so it must not call methods of Drainable.
+func (d *Drainable) OnTransition(observer func(t Transition)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.onTransition = observer
+}
+
+// Transitions returns recent transitions, oldest first.
+func (d *Drainable) Transitions() []Transition {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]Transition(nil), d.transitions...)
+}
+
+// setStatus changes status and records the transition. It should be called with lock.
+func (d *Drainable) setStatus(to Status, err error) {
+	t := Transition{From: d.status, To: to, At: d.clock.Now(), Err: err}
+	d.status = to
+	if err != nil {
+		d.error = err
+	}
+	if len(d.transitions) == TransitionLogSize {
+		d.transitions = append(d.transitions[:0], d.transitions[1:]...)
+	}
+	d.transitions = append(d.transitions, t)
+	if d.onTransition != nil {
+		d.onTransition(t)
+	}
+}
+
+func (d *Drainable) Exec(job func()) error {
+	return d.ExecContext(context.Background(), job)
+}
+
+// ExecContext is Exec that stops waiting for the wake when ctx is canceled.
+// The job doesn't run and ctx.Err() is returned in that case.
+func (d *Drainable) ExecContext(ctx context.Context, job func()) error {
+	d.lock.Lock()
+	policy, now := d.policy, d.clock.Now()
+	d.lock.Unlock()
+	policy.Observe(now)
+	return d.exec(ctx, job)
+}
+
+func (d *Drainable) exec(ctx context.Context, job func()) error {
+	d.lock.Lock()
+	for {
+		switch d.status {
+		case Drained:
+			d.setStatus(Waking, nil)
+			d.peakQueued = 0
+			wakeCtx, cancel := context.WithCancel(context.Background())
+			d.cancelWake = cancel
+			go d.wake(wakeCtx, cancel)
+			// the job that started the wake is not limited by the queue
+			if err := d.waitLocked(ctx, false); err != nil {
+				d.lock.Unlock()
+				return err
+			}
+		case Waking, Rebooting:
+			if err := d.waitLocked(ctx, true); err != nil {
+				d.lock.Unlock()
+				return err
+			}
+		case Draining:
+			// closeService is running. timeout() boots service again after that
+			d.setStatus(Rebooting, nil)
+		case Waked:
+			if d.sleep && (d.inFlight == 0 || !d.graceful) {
+				// wait for draining and boot again like jobs during draining
+				d.reboot = true
+				if err := d.waitLocked(ctx, true); err != nil {
+					d.lock.Unlock()
+					return err
+				}
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				d.lock.Unlock()
+				return err
+			}
+			d.inFlight++
+			d.stopTimer()
+			d.lock.Unlock()
+			defer d.done()
+			job()
+			return nil
+		case Failed:
+			err := d.error
+			d.lock.Unlock()
+			return err
+		default: // Terminated
+			d.lock.Unlock()
+			return nil
+		}
+	}
+}
+
+// wake boots the service in background, so jobs waiting for it can leave.
+func (d *Drainable) wake(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+	err := d.bootService(ctx)
+	d.lock.Lock()
+	d.cancelWake = nil
+	switch {
+	case d.status == Terminated:
+	case err == nil:
+		d.setStatus(Waked, nil)
+		d.startIdleTimer()
+	case ctx.Err() != nil: // abandoned
+		d.setStatus(Drained, err)
+	default:
+		d.setStatus(Failed, err)
+	}
+	status := d.status
+	d.lock.Unlock()
+	// callback runs before waiting jobs resume, so they observe the new status
+	d.callback(status)
+	d.lock.Lock()
+	d.notify()
+	d.lock.Unlock()
+}
+
+// waitLocked waits for the next status change within queue limits if limited is true.
+// It should be called with lock, and it returns with lock.
+func (d *Drainable) waitLocked(ctx context.Context, limited bool) error {
+	if limited && d.maxQueued > 0 && d.queued >= d.maxQueued {
+		d.rejected++
+		return ErrQueueFull
+	}
+	if limited {
+		d.queued++
+		d.peakQueued = max(d.peakQueued, d.queued)
+	}
+	d.waiters++
+	wait := d.wait
+	var timeout <-chan time.Time
+	if limited && d.maxWait > 0 {
+		timer := d.clock.NewTimer(d.maxWait)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	d.lock.Unlock()
+	var err error
+	select {
+	case <-wait:
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	d.lock.Lock()
+	if limited {
+		d.queued--
+	}
+	d.waiters--
+	if errors.Is(err, ErrQueueTimeout) {
+		d.rejected++
+	}
+	if err != nil && d.waiters == 0 && d.status == Waking && d.cancelIdle && d.cancelWake != nil {
+		d.cancelWake()
+	}
+	return err
+}
+
+// done is called when job finishes. The last job starts drain timer.
+func (d *Drainable) done() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.inFlight--
+	d.startIdleTimer()
+}
+
+// startIdleTimer starts drain timer if no jobs run. It should be called with lock.
+func (d *Drainable) startIdleTimer() {
+	if d.inFlight > 0 || d.status != Waked {
+		return
+	}
+	timeout := d.policy.Timeout()
+	if d.sleep {
+		timeout = 0
+	}
+	d.idle = true
+	d.deadline = d.clock.Now().Add(timeout)
+	d.timer.Reset(timeout)
+}
+
+// stopTimer should be called with lock.
+func (d *Drainable) stopTimer() {
+	d.idle = false
+	d.timer.Stop()
+}
+
+// Hold keeps the service awake until release is called. It boots the service if needed.
+//
+// It doesn't affect DrainPolicy because it is not a job from outside. Sleep doesn't wait for holds:
+// they move to the next service, so the service is kept awake until release over the reboot.
+func (d *Drainable) Hold() (release func(), err error) {
+	started := make(chan struct{})
+	start := sync.OnceFunc(func() { close(started) })
+	released := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		for {
+			moved := false
+			err := d.exec(context.Background(), func() {
+				d.lock.Lock()
+				unhold, moving := d.unhold, d.sleep && !d.graceful
+				d.lock.Unlock()
+				start()
+				if moving {
+					moved = true
+					return
+				}
+				select {
+				case <-released:
+				case <-unhold:
+					moved = true
+				}
+			})
+			if err != nil || !moved {
+				result <- err
+				return
+			}
+			select {
+			case <-released: // released while moving, so the next service is not needed for it
+				result <- nil
+				return
+			default:
+			}
+		}
+	}()
+	select {
+	case <-started:
+		return sync.OnceFunc(func() { close(released) }), nil
+	case err := <-result:
+		return func() {}, err
+	}
+}
+
+// Sleep drains the service as soon as running jobs finish, without waiting drain timeout.
+//
+// Jobs that come after Sleep wait for draining, then boot the service again. It reports whether
+// draining starts. It is false if the service is not awake or draining already started.
+func (d *Drainable) Sleep() bool {
+	return d.SleepWithin(0)
+}
+
+// SleepWithin is Sleep that keeps serving jobs by the current service during grace.
+//
+// The service drains at the first moment no jobs run during grace. After grace, it works like Sleep,
+// so long jobs or overlapping jobs can't postpone draining forever.
+func (d *Drainable) SleepWithin(grace time.Duration) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.status != Waked || d.sleep && (!d.graceful || grace > 0) {
+		return false
+	}
+	d.sleep = true
+	if grace > 0 {
+		d.graceful = true
+		d.graceTimer = d.clock.AfterFunc(grace, d.endGrace)
+	} else {
+		d.endGraceLocked()
+	}
+	d.startIdleTimer()
+	return true
+}
+
+func (d *Drainable) endGrace() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.sleep && d.graceful && d.status == Waked {
+		d.endGraceLocked()
+	}
+}
+
+// endGraceLocked stops admitting jobs to the current service and moves holds. It should be called with lock.
+func (d *Drainable) endGraceLocked() {
+	d.graceful = false
+	if d.graceTimer != nil {
+		d.graceTimer.Stop()
+		d.graceTimer = nil
+	}
+	close(d.unhold)
+	d.unhold = make(chan struct{})
+}
+
+// notify wakes up waiting jobs. It should be called with lock.
+func (d *Drainable) notify() {
+	close(d.wait)
+	d.wait = make(chan struct{})
+}
+
+// Terminate stops the idle timer. Following jobs do nothing.
+func (d *Drainable) Terminate() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopTimer()
+	if d.cancelWake != nil {
+		d.cancelWake()
+	}
+	d.setStatus(Terminated, nil)
+	d.notify()
+}
+
+// IsWaking reports whether the service is ready.
+func (d *Drainable) IsWaking() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.status == Waked
+}
+
+func (d *Drainable) Status() Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.status
+}
+
+// Queued returns count of jobs waiting for wake.
+func (d *Drainable) Queued() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.queued
+}
+
+// PeakQueued returns max count of jobs that waited for the last wake.
+func (d *Drainable) PeakQueued() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.peakQueued
+}
+
+// QueueRejected returns count of jobs rejected by queue limits.
+func (d *Drainable) QueueRejected() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.rejected
+}
+
+func (d *Drainable) timeout() {
+	d.lock.Lock()
+	if !d.idle || d.inFlight > 0 || d.status != Waked {
+		d.lock.Unlock()
+		return
+	}
+	if d.clock.Now().Before(d.deadline) {
+		// stale fire before the timer was reset. The timer fires again at the deadline
+		d.lock.Unlock()
+		return
+	}
+	d.idle = false
+	next := Draining
+	if d.reboot {
+		next = Rebooting
+	}
+	d.setStatus(next, nil)
+	d.sleep = false
+	if d.graceTimer != nil {
+		d.graceTimer.Stop()
+		d.graceTimer = nil
+	}
+	d.graceful = false
+	d.reboot = false
+	d.peakQueued = d.queued
+	d.lock.Unlock()
+	err := d.closeService()
+	d.lock.Lock()
+	switch {
+	case d.status == Terminated:
+	case err != nil:
+		d.setStatus(Failed, err)
+	case d.status == Draining:
+		d.setStatus(Drained, nil)
+	case d.status == Rebooting: // jobs came while draining
+		d.lock.Unlock()
+		// the service is closed once, so callback observes the cycle before the boot
+		d.callback(Drained)
+		err = d.bootService(context.Background())
+		d.lock.Lock()
+		if d.status == Terminated {
+			break
+		}
+		if err == nil {
+			d.setStatus(Waked, nil)
+			d.startIdleTimer()
+		} else {
+			d.setStatus(Failed, err)
+		}
+	}
+	status := d.status
+	d.lock.Unlock()
+	// callback runs before waiting jobs resume like wake
+	d.callback(status)
+	d.lock.Lock()
+	d.notify()
+	d.lock.Unlock()
+}
@@ -0,0 +1,507 @@
+package drainable
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+// lastStatus records the status passed to callback.
+type lastStatus struct {
+	v atomic.Int64
+}
+
+func (l *lastStatus) set(s Status) {
+	l.v.Store(int64(s))
+}
+
+func (l *lastStatus) get() Status {
+	return Status(l.v.Load())
+}
+
+var ErrBoot = errors.New("error boot")
+var ErrClose = errors.New("error close")
+
+func fail(err error) func() error {
+	return func() error {
+		return err
+	}
+}
+
+// gate blocks boot or close until it is opened, and tells when it is entered.
+type gate struct {
+	entered chan struct{}
+	open    chan struct{}
+	err     error
+}
+
+func newGate(err error) *gate {
+	return &gate{entered: make(chan struct{}, 1), open: make(chan struct{}), err: err}
+}
+
+func (g *gate) run() error {
+	g.entered <- struct{}{}
+	<-g.open
+	return g.err
+}
+
+// newFake creates Drainable with fake clock. The status passed to callback is recorded to the returned lastStatus.
+func newFake(boot, close func() error, timeout time.Duration) (*Drainable, *clocktest.Fake, *lastStatus) {
+	status := &lastStatus{}
+	d := New(boot, close, timeout, status.set)
+	clk := clocktest.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	d.SetClock(clk)
+	return d, clk, status
+}
+
+// waitTransition returns a channel that is closed when Drainable moves to the status.
+func waitTransition(d *Drainable, to Status) <-chan struct{} {
+	result := make(chan struct{})
+	once := sync.OnceFunc(func() { close(result) })
+	d.OnTransition(func(t Transition) {
+		if t.To == to {
+			once()
+		}
+	})
+	return result
+}
+
+func TestWake(t *testing.T) {
+	boot := newGate(nil)
+	d, _, status := newFake(boot.run, fail(nil), time.Second)
+	assert.False(t, d.IsWaking())
+	wg := &sync.WaitGroup{}
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, d.Exec(func() {}))
+		}()
+	}
+	<-boot.entered
+	assert.Equal(t, Waking, d.Status())
+	close(boot.open)
+	wg.Wait()
+	assert.True(t, d.IsWaking())
+	assert.Equal(t, Waked, status.get())
+}
+
+func TestDrained(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	d, clk, status := newFake(fail(nil), fail(nil), timeout)
+	assert.NoError(t, d.Exec(func() {}))
+	assert.Equal(t, Waked, status.get())
+
+	clk.Advance(timeout - time.Millisecond)
+	assert.True(t, d.IsWaking())
+	clk.Advance(time.Millisecond) // job is drained after timeout duration
+	assert.False(t, d.IsWaking())
+	assert.Equal(t, Drained, status.get())
+}
+
+func TestStartJobDuringDraining(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	closing := newGate(nil)
+	var boots atomic.Int32
+	d, clk, status := newFake(func() error {
+		boots.Add(1)
+		return nil
+	}, closing.run, timeout)
+	assert.NoError(t, d.Exec(func() {}))
+
+	go clk.Advance(timeout)
+	<-closing.entered
+	assert.Equal(t, Draining, d.Status())
+
+	rebooting := waitTransition(d, Rebooting)
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	<-rebooting
+	close(closing.open)
+	assert.NoError(t, <-result)
+	assert.Equal(t, Waked, status.get())
+	assert.Equal(t, int32(2), boots.Load())
+}
+
+func TestFailedToStart(t *testing.T) {
+	d, _, status := newFake(fail(ErrBoot), fail(nil), time.Second)
+	err := d.Exec(func() {})
+	assert.IsError(t, err, ErrBoot)
+	assert.False(t, d.IsWaking())
+	assert.Equal(t, Failed, status.get())
+}
+
+func TestFailedToClose(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	d, clk, status := newFake(fail(nil), fail(ErrClose), timeout)
+	assert.NoError(t, d.Exec(func() {}))
+	assert.Equal(t, Waked, status.get())
+
+	clk.Advance(timeout)
+	assert.False(t, d.IsWaking())
+	assert.Equal(t, Failed, status.get())
+	assert.IsError(t, d.Exec(func() {}), ErrClose)
+}
+
+func TestDrainTimeoutIsResetByActivity(t *testing.T) {
+	var closed atomic.Int32
+	timeout := 100 * time.Millisecond
+	d, clk, _ := newFake(fail(nil), func() error {
+		closed.Add(1)
+		return nil
+	}, timeout)
+	for range 5 {
+		assert.NoError(t, d.Exec(func() {}))
+		clk.Advance(timeout / 2)
+	}
+	assert.True(t, d.IsWaking())
+	assert.Equal(t, int32(0), closed.Load())
+	clk.Advance(timeout / 2)
+	assert.False(t, d.IsWaking())
+	assert.Equal(t, int32(1), closed.Load())
+}
+
+func TestLongJobKeepsAwake(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	d, clk, _ := newFake(fail(nil), fail(nil), timeout)
+	assert.NoError(t, d.Exec(func() {
+		clk.Advance(3 * timeout)
+		assert.Equal(t, Waked, d.Status())
+	}))
+	clk.Advance(timeout)
+	assert.Equal(t, Drained, d.Status())
+}
+
+func TestRebootCallback(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	closing := newGate(nil)
+	var lock sync.Mutex
+	var callbacks []Status
+	d := New(fail(nil), closing.run, timeout, func(s Status) {
+		lock.Lock()
+		defer lock.Unlock()
+		callbacks = append(callbacks, s)
+	})
+	clk := clocktest.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	d.SetClock(clk)
+	assert.NoError(t, d.Exec(func() {}))
+	go clk.Advance(timeout)
+	<-closing.entered
+
+	rebooting := waitTransition(d, Rebooting)
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	<-rebooting
+	close(closing.open)
+	assert.NoError(t, <-result)
+	// the job resumes after callbacks, and the close between boots is reported too
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []Status{Waked, Drained, Waked}, callbacks)
+}
+
+func TestFailedToReboot(t *testing.T) {
+	var boots atomic.Int32
+	timeout := 100 * time.Millisecond
+	closing := newGate(nil)
+	d, clk, status := newFake(func() error {
+		if boots.Add(1) > 1 {
+			return ErrBoot
+		}
+		return nil
+	}, closing.run, timeout)
+	assert.NoError(t, d.Exec(func() {}))
+	go clk.Advance(timeout)
+	<-closing.entered
+
+	rebooting := waitTransition(d, Rebooting)
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	<-rebooting
+	close(closing.open)
+	assert.IsError(t, <-result, ErrBoot)
+	assert.Equal(t, Failed, status.get())
+}
+
+func TestHold(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	d, clk, _ := newFake(fail(nil), fail(nil), timeout)
+	release, err := d.Hold()
+	assert.NoError(t, err)
+	clk.Advance(2 * timeout)
+	assert.Equal(t, Waked, d.Status())
+
+	drained := waitTransition(d, Drained)
+	release()
+	release() // release twice is safe
+	clk.BlockUntil(1)
+	clk.Advance(timeout)
+	<-drained
+}
+
+func TestSleep(t *testing.T) {
+	var boots atomic.Int32
+	closing := newGate(nil)
+	d, clk, _ := newFake(func() error {
+		boots.Add(1)
+		return nil
+	}, closing.run, time.Hour)
+	assert.NoError(t, d.Exec(func() {}))
+
+	// running job finishes before draining
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- d.Exec(func() {
+			close(started)
+			<-finish
+		})
+	}()
+	<-started
+	d.Sleep()
+	assert.Equal(t, Waked, d.Status())
+	close(finish)
+	assert.NoError(t, <-finished)
+	go clk.Advance(0)
+	<-closing.entered
+	assert.Equal(t, Draining, d.Status())
+	drained := waitTransition(d, Drained)
+	closing.open <- struct{}{}
+	<-drained
+	assert.Equal(t, int32(1), boots.Load())
+
+	// jobs after Sleep boot the service again
+	assert.NoError(t, d.Exec(func() {}))
+	d.Sleep()
+	go clk.Advance(0)
+	<-closing.entered
+	called := false
+	rebooting := waitTransition(d, Rebooting)
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() { called = true })
+	}()
+	<-rebooting
+	closing.open <- struct{}{}
+	assert.NoError(t, <-result)
+	assert.True(t, called)
+	assert.Equal(t, Waked, d.Status())
+	assert.Equal(t, int32(3), boots.Load())
+}
+
+// waitWaiters waits until clk has n timers.
+func waitWaiters(t *testing.T, clk *clocktest.Fake, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clk.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timers should be %d, but %d", n, clk.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSleepWhileHeld(t *testing.T) {
+	var boots atomic.Int32
+	d, clk, _ := newFake(func() error {
+		boots.Add(1)
+		return nil
+	}, fail(nil), time.Hour)
+	release, err := d.Hold()
+	assert.NoError(t, err)
+	assert.True(t, d.Sleep())
+	assert.False(t, d.Sleep())
+
+	// the hold doesn't postpone draining. It moves to the next service with jobs after Sleep
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	waitWaiters(t, clk, 1)
+	clk.Advance(0)
+	assert.NoError(t, <-result)
+	assert.Equal(t, int32(2), boots.Load())
+
+	// the hold keeps the next service awake
+	waitWaiters(t, clk, 0)
+	clk.Advance(2 * time.Hour)
+	assert.Equal(t, Waked, d.Status())
+	release()
+	waitWaiters(t, clk, 1)
+	clk.Advance(time.Hour)
+	assert.Equal(t, Drained, d.Status())
+}
+
+func TestSleepWithin(t *testing.T) {
+	var boots atomic.Int32
+	d, clk, _ := newFake(func() error {
+		boots.Add(1)
+		return nil
+	}, fail(nil), time.Hour)
+	assert.NoError(t, d.Exec(func() {}))
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- d.Exec(func() {
+			close(started)
+			<-finish
+		})
+	}()
+	<-started
+	assert.True(t, d.SleepWithin(time.Minute))
+
+	// jobs during grace are served by the current service
+	assert.NoError(t, d.Exec(func() {}))
+	assert.Equal(t, int32(1), boots.Load())
+
+	// jobs after grace wait for draining even if the running job doesn't finish
+	clk.Advance(time.Minute)
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	close(finish)
+	assert.NoError(t, <-finished)
+	waitWaiters(t, clk, 1)
+	clk.Advance(0)
+	assert.NoError(t, <-result)
+	assert.Equal(t, int32(2), boots.Load())
+}
+
+func TestQueueLimit(t *testing.T) {
+	boot := newGate(nil)
+	d, _, _ := newFake(boot.run, fail(nil), time.Second)
+	d.SetQueueLimit(2, 0)
+	first := make(chan error)
+	go func() {
+		first <- d.Exec(func() {}) // boots the service
+	}()
+	<-boot.entered
+
+	var succeeded, full atomic.Int32
+	wg := &sync.WaitGroup{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.Exec(func() {})
+			if err == nil {
+				succeeded.Add(1)
+			} else if errors.Is(err, ErrQueueFull) {
+				full.Add(1)
+			}
+		}()
+	}
+	for d.QueueRejected() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(boot.open)
+	wg.Wait()
+	assert.NoError(t, <-first)
+	assert.Equal(t, int32(2), succeeded.Load())
+	assert.Equal(t, int32(2), full.Load())
+	assert.Equal(t, 2, d.PeakQueued())
+	assert.Equal(t, 0, d.Queued())
+}
+
+func TestQueueTimeout(t *testing.T) {
+	boot := newGate(nil)
+	d, clk, _ := newFake(boot.run, fail(nil), time.Second)
+	d.SetQueueLimit(0, 50*time.Millisecond)
+	go d.Exec(func() {})
+	<-boot.entered
+
+	result := make(chan error)
+	go func() {
+		result <- d.Exec(func() {})
+	}()
+	clk.BlockUntil(1) // queue timer of the second job
+	clk.Advance(50 * time.Millisecond)
+	assert.IsError(t, <-result, ErrQueueTimeout)
+	close(boot.open)
+	assert.NoError(t, d.Exec(func() {}))
+}
+
+func TestExecContextCanceled(t *testing.T) {
+	boot := newGate(nil)
+	d, _, _ := newFake(boot.run, fail(nil), time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran atomic.Bool
+	result := make(chan error)
+	go func() {
+		result <- d.ExecContext(ctx, func() { ran.Store(true) })
+	}()
+	<-boot.entered
+	cancel()
+	assert.IsError(t, <-result, context.Canceled)
+	assert.False(t, ran.Load())
+
+	// the wake continues without waiting jobs
+	waked := waitTransition(d, Waked)
+	close(boot.open)
+	<-waked
+}
+
+func TestCancelAbandonedWake(t *testing.T) {
+	callbacks := make(chan Status, 1)
+	d := NewContext(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, fail(nil), time.Second, func(s Status) {
+		callbacks <- s
+	})
+	d.SetCancelAbandonedWake(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := d.ExecContext(ctx, func() {})
+	assert.IsError(t, err, context.Canceled)
+	assert.Equal(t, Drained, <-callbacks)
+	assert.Equal(t, Drained, d.Status())
+}
+
+func TestTransitions(t *testing.T) {
+	var observed []Transition
+	timeout := 50 * time.Millisecond
+	d, clk, _ := newFake(fail(nil), fail(ErrClose), timeout)
+	d.OnTransition(func(t Transition) {
+		observed = append(observed, t)
+	})
+	assert.NoError(t, d.Exec(func() {}))
+	clk.Advance(timeout)
+
+	want := []Status{Waking, Waked, Draining, Failed}
+	transitions := d.Transitions()
+	assert.Equal(t, len(want), len(transitions))
+	from := Drained
+	for i, tr := range transitions {
+		assert.Equal(t, from, tr.From)
+		assert.Equal(t, want[i], tr.To)
+		from = tr.To
+	}
+	assert.IsError(t, transitions[3].Err, ErrClose)
+	assert.Equal(t, clk.Now(), transitions[3].At)
+	d.Terminate()
+	assert.Equal(t, Terminated, d.Status())
+	assert.NoError(t, d.Exec(func() {}))
+	// OnTransition is called with lock, so observed is safe to read after Terminate
+	assert.Equal(t, 5, len(observed))
+}
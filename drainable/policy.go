@@ -0,0 +1,120 @@
+package drainable
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrDrainPolicy = errors.New("drain policy error")
+
+// DrainPolicy decides how long Drainable keeps the service after the last job.
+type DrainPolicy interface {
+	// Observe is called when a job arrives.
+	Observe(at time.Time)
+	// Timeout returns idle duration before draining.
+	Timeout() time.Duration
+}
+
+// FixedDrainPolicy always uses the same drain timeout.
+type FixedDrainPolicy time.Duration
+
+func (p FixedDrainPolicy) Observe(at time.Time) {}
+
+func (p FixedDrainPolicy) Timeout() time.Duration {
+	return time.Duration(p)
+}
+
+var _ DrainPolicy = FixedDrainPolicy(0)
+
+// adaptiveSamples is count of inter-arrival times AdaptiveDrainPolicy keeps.
+const adaptiveSamples = 64
+
+// AdaptiveDrainPolicy learns inter-arrival times of jobs and picks drain timeout between Min and Max.
+//
+// For each recent inter-arrival time g and candidate timeout T, the cost is g if the service
+// stays awake until the next job (g <= T), otherwise T + WakeCost. It picks T that minimizes
+// the total cost, so it balances how often it wakes against memory held.
+type AdaptiveDrainPolicy struct {
+	Min      time.Duration // Lower bound of drain timeout
+	Max      time.Duration // Upper bound of drain timeout
+	WakeCost time.Duration // A wake is as expensive as staying awake for this duration
+	initial  time.Duration
+	lock     sync.Mutex
+	last     time.Time
+	gaps     []time.Duration
+	next     int
+}
+
+// NewAdaptiveDrainPolicy creates AdaptiveDrainPolicy. It uses initial until it observes jobs.
+//
+// initial is also used as WakeCost: holding memory for the configured drain timeout is
+// what the user accepts to avoid a wake.
+func NewAdaptiveDrainPolicy(initial, min, max time.Duration) *AdaptiveDrainPolicy {
+	return &AdaptiveDrainPolicy{
+		Min:      min,
+		Max:      max,
+		WakeCost: initial,
+		initial:  initial,
+	}
+}
+
+func (p *AdaptiveDrainPolicy) Observe(at time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.last.IsZero() && at.After(p.last) {
+		gap := at.Sub(p.last)
+		if len(p.gaps) < adaptiveSamples {
+			p.gaps = append(p.gaps, gap)
+		} else {
+			p.gaps[p.next] = gap
+			p.next = (p.next + 1) % adaptiveSamples
+		}
+	}
+	p.last = at
+}
+
+func (p *AdaptiveDrainPolicy) Timeout() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.gaps) == 0 {
+		return min(max(p.initial, p.Min), p.Max)
+	}
+	candidates := []time.Duration{p.Min, p.Max}
+	for _, gap := range p.gaps {
+		if gap > p.Min && gap < p.Max {
+			candidates = append(candidates, gap)
+		}
+	}
+	slices.Sort(candidates)
+	cost := func(timeout time.Duration) time.Duration {
+		var result time.Duration
+		for _, gap := range p.gaps {
+			if gap <= timeout {
+				result += gap
+			} else {
+				result += timeout + p.WakeCost
+			}
+		}
+		return result
+	}
+	return slices.MinFunc(candidates, func(a, b time.Duration) int {
+		return cmp.Or(cmp.Compare(cost(a), cost(b)), cmp.Compare(a, b))
+	})
+}
+
+var _ DrainPolicy = (*AdaptiveDrainPolicy)(nil)
+
+// NewDrainPolicy creates policy by name: "fixed" or "adaptive".
+func NewDrainPolicy(name string, drainTimeout, min, max time.Duration) (DrainPolicy, error) {
+	switch name {
+	case "", "fixed":
+		return FixedDrainPolicy(drainTimeout), nil
+	case "adaptive":
+		return NewAdaptiveDrainPolicy(drainTimeout, min, max), nil
+	default:
+		return nil, ErrDrainPolicy
+	}
+}
@@ -0,0 +1,53 @@
+package drainable
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func observeGaps(p DrainPolicy, gaps ...time.Duration) {
+	now := time.Now()
+	p.Observe(now)
+	for _, gap := range gaps {
+		now = now.Add(gap)
+		p.Observe(now)
+	}
+}
+
+func TestAdaptiveDrainPolicy(t *testing.T) {
+	t.Run("initial", func(t *testing.T) {
+		p := NewAdaptiveDrainPolicy(time.Minute, 10*time.Second, 10*time.Minute)
+		assert.Equal(t, time.Minute, p.Timeout())
+		p = NewAdaptiveDrainPolicy(time.Second, 10*time.Second, 10*time.Minute)
+		assert.Equal(t, 10*time.Second, p.Timeout())
+	})
+	t.Run("regular requests keep awake", func(t *testing.T) {
+		p := NewAdaptiveDrainPolicy(time.Minute, 10*time.Second, 10*time.Minute)
+		observeGaps(p, 30*time.Second, 40*time.Second, 35*time.Second, 20*time.Second)
+		assert.Equal(t, 40*time.Second, p.Timeout())
+	})
+	t.Run("sparse requests sleep early", func(t *testing.T) {
+		p := NewAdaptiveDrainPolicy(time.Minute, 10*time.Second, 10*time.Minute)
+		observeGaps(p, time.Second, time.Hour, 2*time.Second, 3*time.Hour, time.Second)
+		assert.Equal(t, 10*time.Second, p.Timeout())
+	})
+	t.Run("bounded by max", func(t *testing.T) {
+		p := NewAdaptiveDrainPolicy(time.Minute, 10*time.Second, 10*time.Minute)
+		observeGaps(p, 5*time.Minute, 15*time.Minute, 5*time.Minute)
+		assert.Equal(t, 10*time.Second, p.Timeout())
+		p.WakeCost = time.Hour
+		assert.Equal(t, 5*time.Minute, p.Timeout())
+		p.Max = 3 * time.Minute
+		assert.Equal(t, 10*time.Second, p.Timeout())
+	})
+}
+
+func TestNewDrainPolicy(t *testing.T) {
+	p, err := NewDrainPolicy("fixed", time.Minute, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, p.Timeout())
+	_, err = NewDrainPolicy("random", time.Minute, 0, 0)
+	assert.IsError(t, err, ErrDrainPolicy)
+}
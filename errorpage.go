@@ -0,0 +1,167 @@
+package saving
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorKindHeader is a response header that tells which error happened in saving.
+const ErrorKindHeader = "X-Saving-Error"
+
+type ErrorKind int
+
+const (
+	WakeTimeout     ErrorKind = iota + 1 // The server process didn't become healthy within wake timeout
+	WakeFailed                           // The server process is in failed state
+	UpstreamRefused                      // The server process is awake but the request to it failed
+	QueueFull                            // Too many requests are waiting for wake, or the request waited too long
+	WakeLimited                          // The source woke the server process too many times
+	WakeDenied                           // The source is not allowed to wake the server process
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case WakeTimeout:
+		return "wake-timeout"
+	case WakeFailed:
+		return "failed"
+	case UpstreamRefused:
+		return "upstream-refused"
+	case QueueFull:
+		return "queue-full"
+	case WakeLimited:
+		return "wake-limited"
+	case WakeDenied:
+		return "wake-denied"
+	default:
+		return "unknown"
+	}
+}
+
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case WakeTimeout:
+		return http.StatusGatewayTimeout
+	case WakeFailed, QueueFull:
+		return http.StatusServiceUnavailable
+	case WakeLimited:
+		return http.StatusTooManyRequests
+	case WakeDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ErrorHandler writes response when saving can't pass the request to the server process.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, kind ErrorKind, err error)
+
+// ErrorPageParams is passed to error page templates.
+type ErrorPageParams struct {
+	StatusCode int    // HTTP status code like 504
+	Status     string // HTTP status text like "Gateway Timeout"
+	Kind       string // Error kind like "wake-timeout"
+	Message    string // Error detail
+	Path       string // Requested path
+}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.StatusCode}} {{.Status}}</title>
+<style>body{font-family:sans-serif;text-align:center;margin-top:20vh;color:#444}</style>
+</head>
+<body>
+<h1>{{.StatusCode}} {{.Status}}</h1>
+<p>{{.Kind}}</p>
+</body>
+</html>
+`
+
+const defaultErrorJson = `{"status":{{.StatusCode}},"error":{{json .Kind}},"message":{{json .Message}}}
+`
+
+// LoadErrorPage loads HTML error page template. Empty path means built-in page.
+func LoadErrorPage(src string) (*template.Template, error) {
+	if src == "" {
+		return template.New("error").Parse(defaultErrorPage)
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("error").Parse(string(content))
+}
+
+// LoadErrorJson loads JSON error body template. Empty path means built-in body.
+//
+// Template can use json function to encode values.
+func LoadErrorJson(src string) (*texttemplate.Template, error) {
+	t := texttemplate.New("error").Funcs(texttemplate.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	})
+	if src == "" {
+		return t.Parse(defaultErrorJson)
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	return t.Parse(string(content))
+}
+
+// NewErrorHandler creates ErrorHandler that renders templates.
+//
+// HTML template is used for requests that accept text/html, otherwise JSON template is used.
+// gRPC requests get UNAVAILABLE gRPC status instead.
+// Nil template means built-in one.
+func NewErrorHandler(page *template.Template, jsonBody *texttemplate.Template, logger *slog.Logger) ErrorHandler {
+	if page == nil {
+		page, _ = LoadErrorPage("")
+	}
+	if jsonBody == nil {
+		jsonBody, _ = LoadErrorJson("")
+	}
+	return func(w http.ResponseWriter, r *http.Request, kind ErrorKind, err error) {
+		params := ErrorPageParams{
+			StatusCode: kind.StatusCode(),
+			Status:     http.StatusText(kind.StatusCode()),
+			Kind:       kind.String(),
+			Path:       r.URL.Path,
+		}
+		if err != nil {
+			params.Message = err.Error()
+		}
+		if logger != nil {
+			logger.Warn("proxy error", "kind", params.Kind, "path", params.Path, "detail", params.Message)
+		}
+		w.Header().Set(ErrorKindHeader, params.Kind)
+		w.Header().Set("Cache-Control", "no-store")
+		if isGRPC(r) {
+			writeGRPCError(w, params.Kind+": "+params.Message, 0)
+			return
+		}
+		var renderErr error
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(params.StatusCode)
+			renderErr = page.Execute(w, params)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(params.StatusCode)
+			renderErr = jsonBody.Execute(w, params)
+		}
+		if renderErr != nil && logger != nil {
+			logger.Warn("error page error", "detail", renderErr.Error())
+		}
+	}
+}
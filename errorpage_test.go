@@ -0,0 +1,59 @@
+package saving
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestProxyErrors(t *testing.T) {
+	// nothing listens on port 1
+	dest, _ := url.Parse("http://localhost:1")
+
+	testcases := []struct {
+		name    string
+		process *stubProcess
+		want    int
+		kind    string
+	}{
+		{"wake timeout", &stubProcess{status: Drained, err: ErrHealthCheckFailed}, http.StatusGatewayTimeout, "wake-timeout"},
+		{"failed state", &stubProcess{status: Failed, err: ErrHealthCheckFailed}, http.StatusServiceUnavailable, "failed"},
+		{"other boot error", &stubProcess{status: Drained, err: errors.New("exec error")}, http.StatusServiceUnavailable, "failed"},
+		{"upstream refused", &stubProcess{status: Waked}, http.StatusBadGateway, "upstream-refused"},
+		{"queue full", &stubProcess{status: Drained, err: ErrQueueFull}, http.StatusServiceUnavailable, "queue-full"},
+		{"queue timeout", &stubProcess{status: Drained, err: ErrQueueTimeout}, http.StatusServiceUnavailable, "queue-full"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewHandler(tc.process, dest, ProxyOption{})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, tc.want, w.Code)
+			assert.Equal(t, tc.kind, w.Header().Get(ErrorKindHeader))
+			if tc.kind == "queue-full" {
+				assert.Equal(t, "2", w.Header().Get("Retry-After"))
+			}
+
+			var body map[string]any
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tc.kind, body["error"].(string))
+		})
+	}
+}
+
+func TestErrorPageByAccept(t *testing.T) {
+	handler := NewErrorHandler(nil, nil, nil)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	handler(w, r, WakeTimeout, ErrHealthCheckFailed)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"))
+	assert.True(t, strings.Contains(w.Body.String(), "504 Gateway Timeout"))
+}
@@ -2,70 +2,119 @@ package saving
 
 import (
 	"context"
+	"log/slog"
 	"os"
 	"os/exec"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/shibukawa/saving/clock"
 )
 
+// stopGracePeriod is duration between SIGTERM and SIGKILL.
+const stopGracePeriod = 5 * time.Second
+
 type ExecKillProcessController struct {
 	drainable *Drainable
-	pid       int
+	state     *stateRecorder
+	savings   *savingsTracker
+	recycler  *recycler
+	pid       atomic.Int64 // written by the wake while the memory watcher reads it
 	access    uint64
 	ProcessOption
 }
 
-var _ ProcessController = (*ExecKillProcessController)(nil)
+var (
+	_ ProcessController = (*ExecKillProcessController)(nil)
+	_ StatusReporter    = (*ExecKillProcessController)(nil)
+	_ ContextExecutor   = (*ExecKillProcessController)(nil)
+)
 
 func NewExecKillProcessController(ctx context.Context, opt ProcessOption) (*ExecKillProcessController, error) {
 	err := writePid(opt.PidPath, nil)
 	if err != nil {
 		return nil, err
 	}
+	if opt.Logger == nil {
+		opt.Logger = slog.Default()
+	}
+	opt.Clock = clock.OrReal(opt.Clock)
 
 	result := &ExecKillProcessController{
 		ProcessOption: opt,
+		state:         newStateRecorder(opt.StatePath),
 	}
 
-	drainable := NewDrainable(
+	drainable := NewDrainableContext(
 		result.start,
 		result.stop,
 		opt.DrainTimeout,
 		func(s Status) {
+			result.state.update(func(state *State) {
+				state.Status = s.GoString()
+			})
 			switch s {
+			case Waked:
+				result.state.recordQueue(result.drainable, opt.Logger)
 			case Failed:
+				result.state.recordQueue(result.drainable, opt.Logger)
 				os.Remove(opt.PidPath)
 			}
 		},
 	)
+	policy, err := NewDrainPolicy(opt.DrainPolicy, opt.DrainTimeout, opt.DrainTimeoutMin, opt.DrainTimeoutMax)
+	if err != nil {
+		return nil, err
+	}
+	drainable.SetDrainPolicy(policy)
+	drainable.SetClock(opt.Clock)
+	drainable.SetQueueLimit(opt.MaxQueued, opt.MaxQueueWait)
+	opt.WakeLimiter.recordState(result.state)
+	drainable.SetCancelAbandonedWake(opt.CancelAbandonedWake)
 
 	result.drainable = drainable
+	result.savings = newSavingsTracker(result.state, opt.Clock.Now(), opt.Logger)
+	result.recycler = newRecycler(drainable, opt.MaxAwake, opt.MaxRequests, opt.Clock, opt.Logger)
+	startScheduler(ctx, drainable, opt.AwakeSchedules, opt.PreWake, opt.SleepOutside, opt.Clock, opt.Logger)
+	startMemoryWatcher(ctx, drainable, result.Pid, opt.MemoryLimit, opt.MemoryPressure, result.state, opt.Clock, opt.Logger)
 
 	// force stop process when context is done
 	go func() {
 		<-ctx.Done()
 		result.stop()
 		os.Remove(opt.PidPath)
+		result.state.remove()
 	}()
 
 	return result, nil
 }
 
 func (p *ExecKillProcessController) Exec(callback func()) error {
-	atomic.AddUint64(&p.access, 1)
-	return p.drainable.Exec(callback)
+	return p.ExecContext(context.Background(), callback)
+}
+
+func (p *ExecKillProcessController) ExecContext(ctx context.Context, callback func()) error {
+	return p.drainable.ExecContext(ctx, func() {
+		// counted in the job because the wake by this request resets the count
+		p.recycler.accessed(atomic.AddUint64(&p.access, 1))
+		callback()
+	})
 }
 
 func (p *ExecKillProcessController) IsWaking() bool {
 	return p.drainable.IsWaking()
 }
 
-func (p ExecKillProcessController) Pid() int {
-	return p.pid
+func (p *ExecKillProcessController) Status() Status {
+	return p.drainable.Status()
 }
 
-func (p *ExecKillProcessController) start() error {
+func (p *ExecKillProcessController) Pid() int {
+	return int(p.pid.Load())
+}
+
+func (p *ExecKillProcessController) start(ctx context.Context) error {
 	atomic.StoreUint64(&p.access, 0)
 	cmd := exec.Command(p.Cmd, p.Args...)
 	cmd.Stdout = os.Stdout
@@ -74,21 +123,34 @@ func (p *ExecKillProcessController) start() error {
 	if err != nil {
 		return err
 	}
-	p.pid = cmd.Process.Pid
+	p.pid.Store(int64(cmd.Process.Pid))
 
-	p.Logger.Info("process start", "pid", p.pid)
+	p.Logger.Info("process start", "pid", cmd.Process.Pid)
 
-	status := WaitAndCheckHealth(p.WakeTimeout, p.HealthCheckUrl)
+	status := waitAndCheckHealth(ctx, p.Clock, healthCheckClient(p.HealthCheckTransport), p.WakeTimeout, p.HealthCheckUrl)
 	if !status {
+		if err := ctx.Err(); err != nil {
+			// nobody waits for the wake
+			p.Logger.Info("wake canceled", "pid", cmd.Process.Pid)
+			p.stop()
+			return err
+		}
 		return ErrHealthCheckFailed
 	}
+	p.recycler.started()
+	p.savings.woke(p.Clock.Now())
 	return writePid(p.PidPath, p.HealthCheckUrl)
 }
 
 func (p *ExecKillProcessController) stop() error {
-	p.Logger.Info("process stop", "pid", p.pid, "access", p.access)
+	pid := p.Pid()
+	p.Logger.Info("process stop", "pid", pid, "access", atomic.LoadUint64(&p.access))
+	p.recycler.stopped()
 	writePid(p.PidPath, nil)
-	process, err := os.FindProcess(p.pid)
+	if pid == 0 {
+		return nil // not started yet
+	}
+	process, err := os.FindProcess(pid)
 	if err != nil {
 		return err // already terminated
 	}
@@ -98,18 +160,22 @@ func (p *ExecKillProcessController) stop() error {
 	}
 
 	done := make(chan struct{})
+	var state *os.ProcessState
 
 	go func() {
-		process.Wait()
+		state, _ = process.Wait()
 		close(done)
 	}()
 
+	grace := p.Clock.NewTimer(stopGracePeriod)
+	defer grace.Stop()
 	select {
 	case <-done:
-		return nil
-	case <-time.After(5 * time.Second):
+	case <-grace.C():
 		// send sigkill
 		process.Signal(syscall.SIGKILL)
+		<-done
 	}
+	p.savings.slept(p.Clock.Now(), usageFromProcessState(state))
 	return nil
 }
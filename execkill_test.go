@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
 )
 
 func init() {
@@ -42,24 +44,46 @@ func getExecPath(t *testing.T) string {
 	return execPath
 }
 
+// execFake runs p.Exec while it advances clk for health checks during the wake.
+func execFake(p *ExecKillProcessController, clk *clocktest.Fake, job func()) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- p.Exec(job)
+	}()
+	for {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(10 * time.Millisecond):
+			if p.Status() == Waking {
+				clk.Advance(100 * time.Millisecond)
+			}
+		}
+	}
+}
+
 func TestExecAndTerminate(t *testing.T) {
 	u, _ := url.Parse("http://localhost:8080/health")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	clk := clocktest.NewFake(time.Now())
 
 	p, err := NewExecKillProcessController(ctx, ProcessOption{
 		PidPath:            NormalizePidPath(""),
 		HealthCheckUrl:     u,
-		WakeTimeout:        time.Second,
+		WakeTimeout:        time.Minute,
 		DrainTimeout:       time.Second,
 		HealthCheckTimeout: time.Second,
 		Cmd:                getExecPath(t),
 		Args:               []string{},
+		Clock:              clk,
 	})
+	// drain stops the process before the test ends
+	defer clk.Advance(time.Hour)
 	called := false
 	assert.NoError(t, err)
-	err = p.Exec(func() {
+	err = execFake(p, clk, func() {
 		called = true
 		res, err := http.Get("http://localhost:8080/hello")
 		assert.NoError(t, err)
@@ -68,8 +92,10 @@ func TestExecAndTerminate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, called)
 	assert.True(t, p.IsWaking())
-	time.Sleep(2 * time.Second) // process is terminated
+	clk.Advance(time.Second) // process is terminated
 	assert.False(t, p.IsWaking())
+	// no timers are left after the process exits
+	assert.Equal(t, 0, clk.Waiters())
 }
 
 func TestExecAgain(t *testing.T) {
@@ -77,19 +103,23 @@ func TestExecAgain(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	clk := clocktest.NewFake(time.Now())
 
 	p, err := NewExecKillProcessController(ctx, ProcessOption{
 		PidPath:            NormalizePidPath(""),
 		HealthCheckUrl:     u,
-		WakeTimeout:        time.Second,
+		WakeTimeout:        time.Minute,
 		DrainTimeout:       time.Second,
 		HealthCheckTimeout: time.Second,
 		Cmd:                getExecPath(t),
 		Args:               []string{},
+		Clock:              clk,
 	})
+	// drain stops the process before the test ends
+	defer clk.Advance(time.Hour)
 	called := false
 	assert.NoError(t, err)
-	err = p.Exec(func() {
+	err = execFake(p, clk, func() {
 		called = true
 		res, err := http.Get("http://localhost:8080/hello")
 		assert.NoError(t, err)
@@ -99,12 +129,12 @@ func TestExecAgain(t *testing.T) {
 	assert.True(t, called)
 	assert.True(t, p.IsWaking())
 	initialPid := p.Pid()
-	time.Sleep(2 * time.Second) // process is terminated
+	clk.Advance(time.Second) // process is terminated
 	assert.False(t, p.IsWaking())
 
 	called2 := false
 	// call again: sleepable process kick new process for the next exec request
-	err = p.Exec(func() {
+	err = execFake(p, clk, func() {
 		called2 = true
 		res, err := http.Get("http://localhost:8080/hello")
 		assert.NoError(t, err)
@@ -116,3 +146,38 @@ func TestExecAgain(t *testing.T) {
 
 	assert.NotEqual(t, initialPid, p.Pid())
 }
+
+func TestExecRecycleByRequests(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8080/health")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clocktest.NewFake(time.Now())
+
+	p, err := NewExecKillProcessController(ctx, ProcessOption{
+		PidPath:            NormalizePidPath(""),
+		HealthCheckUrl:     u,
+		WakeTimeout:        time.Minute,
+		DrainTimeout:       time.Hour,
+		HealthCheckTimeout: time.Second,
+		Cmd:                getExecPath(t),
+		Args:               []string{},
+		MaxRequests:        2,
+		Clock:              clk,
+	})
+	// drain stops the process before the test ends
+	defer clk.Advance(time.Hour)
+	assert.NoError(t, err)
+	// the request that wakes the process is the first request of it
+	assert.NoError(t, execFake(p, clk, func() {}))
+	initialPid := p.Pid()
+	clk.Advance(0)
+	assert.True(t, p.IsWaking())
+
+	assert.NoError(t, p.Exec(func() {}))
+	clk.Advance(0)
+	assert.False(t, p.IsWaking())
+
+	assert.NoError(t, execFake(p, clk, func() {}))
+	assert.NotEqual(t, initialPid, p.Pid())
+}
@@ -0,0 +1,209 @@
+package saving
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrExemptRule = errors.New("exempt rule error")
+
+// ExemptRule is a rule for requests that get synthetic response without waking the server process.
+//
+// All specified conditions should match. Empty conditions match any requests.
+type ExemptRule struct {
+	Path      string         // Path glob pattern (path.Match style)
+	Method    string         // HTTP method
+	UserAgent *regexp.Regexp // User-Agent pattern
+	Source    *net.IPNet     // Client address range
+	Status    int            // Response status code (default=204, or 200 if File or Body is specified)
+	File      string         // File to return
+	Body      string         // Text to return
+}
+
+// ParseExemptRules parses rules like "path=/favicon.ico,status=204;ua=^kube-probe/,body=ok".
+//
+// Rules are separated by ';' and each rule has comma separated key=value pairs.
+// Acceptable keys are path, method, ua, cidr, status, file, body.
+// Values can have ';' and ',' escaped as '\;' and '\,' like "ua=^Mozilla/5\.0 \(X11\; Linux,body=a\,b".
+// Other backslashes are kept as is, so ua patterns like '\d' can be written.
+func ParseExemptRules(src string) ([]ExemptRule, error) {
+	var result []ExemptRule
+	var errs []error
+	for _, ruleSrc := range splitEscaped(src, ';') {
+		if strings.TrimSpace(ruleSrc) == "" {
+			continue
+		}
+		var rule ExemptRule
+		conditions := 0
+		for _, pair := range splitEscaped(ruleSrc, ',') {
+			key, value, found := strings.Cut(pair, "=")
+			key = strings.TrimSpace(key)
+			value = exemptRuleEscape.Replace(strings.TrimSpace(value))
+			if !found || value == "" {
+				errs = append(errs, fmt.Errorf("%w: key=value is expected: '%s'", ErrExemptRule, pair))
+				continue
+			}
+			switch key {
+			case "path":
+				if _, err := path.Match(value, "/"); err != nil {
+					errs = append(errs, fmt.Errorf("%w: invalid path pattern: '%s'", ErrExemptRule, value))
+				}
+				rule.Path = value
+				conditions++
+			case "method":
+				rule.Method = strings.ToUpper(value)
+				conditions++
+			case "ua":
+				ua, err := regexp.Compile(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%w: invalid ua pattern: '%s'", ErrExemptRule, value))
+				}
+				rule.UserAgent = ua
+				conditions++
+			case "cidr":
+				_, cidr, err := net.ParseCIDR(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%w: invalid cidr: '%s'", ErrExemptRule, value))
+				}
+				rule.Source = cidr
+				conditions++
+			case "status":
+				status, err := strconv.Atoi(value)
+				if err != nil || status < 100 || status > 599 {
+					errs = append(errs, fmt.Errorf("%w: status should be 100-599: '%s'", ErrExemptRule, value))
+				}
+				rule.Status = status
+			case "file":
+				if _, err := os.Stat(value); err != nil {
+					errs = append(errs, fmt.Errorf("%w: file not found: '%s'", ErrExemptRule, value))
+				}
+				rule.File = value
+			case "body":
+				rule.Body = value
+			default:
+				errs = append(errs, fmt.Errorf("%w: unknown key: '%s'", ErrExemptRule, key))
+			}
+		}
+		if conditions == 0 {
+			errs = append(errs, fmt.Errorf("%w: rule should have at least one condition: '%s'", ErrExemptRule, ruleSrc))
+		}
+		if rule.Status == 0 {
+			if rule.File != "" || rule.Body != "" {
+				rule.Status = http.StatusOK
+			} else {
+				rule.Status = http.StatusNoContent
+			}
+		}
+		result = append(result, rule)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return result, nil
+}
+
+var exemptRuleEscape = strings.NewReplacer(`\;`, ";", `\,`, ",")
+
+// splitEscaped splits src by sep that is not escaped by backslash. Escapes are kept in the results.
+func splitEscaped(src string, sep byte) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case sep:
+			result = append(result, src[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, src[start:])
+}
+
+func (e ExemptRule) Match(r *http.Request) bool {
+	if e.Path != "" {
+		if matched, _ := path.Match(e.Path, r.URL.Path); !matched {
+			return false
+		}
+	}
+	if e.Method != "" && e.Method != r.Method {
+		return false
+	}
+	if e.UserAgent != nil && !e.UserAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+	if e.Source != nil {
+		ip := clientIP(r)
+		if ip == nil || !e.Source.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e ExemptRule) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case e.File != "":
+		f, err := os.Open(e.File)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if e.Status == http.StatusOK {
+			http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+		} else {
+			if ct := mime.TypeByExtension(filepath.Ext(e.File)); ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			w.WriteHeader(e.Status)
+			io.Copy(w, f)
+		}
+	case e.Body != "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(e.Status)
+		fmt.Fprintln(w, e.Body)
+	default:
+		w.WriteHeader(e.Status)
+	}
+}
+
+// clientIP returns address of the client that sent the request.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// withExemptRules answers matched requests without waking the server process.
+func withExemptRules(next http.Handler, opt ProxyOption) http.Handler {
+	if len(opt.ExemptRules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range opt.ExemptRules {
+			if rule.Match(r) {
+				rule.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
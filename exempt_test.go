@@ -0,0 +1,79 @@
+package saving
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestParseExemptRules(t *testing.T) {
+	rules, err := ParseExemptRules("path=/favicon.ico; ua=^kube-probe/, body=ok ;cidr=10.0.0.0/8,method=head,status=200")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rules))
+	assert.Equal(t, http.StatusNoContent, rules[0].Status)
+	assert.Equal(t, http.StatusOK, rules[1].Status)
+	assert.Equal(t, "ok", rules[1].Body)
+	assert.Equal(t, "HEAD", rules[2].Method)
+
+	// separators in values are escaped, and other backslashes are kept for patterns
+	rules, err = ParseExemptRules(`ua=^Mozilla/5\.0 \(X11\; Linux,body=a\,b=c;ua=\d{3}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(rules))
+	assert.Equal(t, `^Mozilla/5\.0 \(X11; Linux`, rules[0].UserAgent.String())
+	assert.Equal(t, "a,b=c", rules[0].Body)
+	assert.Equal(t, `\d{3}`, rules[1].UserAgent.String())
+
+	_, err = ParseExemptRules("status=200")
+	assert.IsError(t, err, ErrExemptRule)
+	_, err = ParseExemptRules("path=/,unknown=1")
+	assert.IsError(t, err, ErrExemptRule)
+	_, err = ParseExemptRules("cidr=10.0.0.0")
+	assert.IsError(t, err, ErrExemptRule)
+}
+
+func TestExemptRules(t *testing.T) {
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	assert.NoError(t, os.WriteFile(robots, []byte("User-agent: *\nDisallow: /\n"), 0o644))
+	rules, err := ParseExemptRules("path=/favicon.ico;path=/robots.txt,file=" + robots + ";ua=^kube-probe/,body=ok;cidr=192.0.2.0/24,status=403")
+	assert.NoError(t, err)
+
+	process := &stubProcess{status: Drained}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		process.Exec(func() {})
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := withExemptRules(next, ProxyOption{ExemptRules: rules})
+
+	testcases := []struct {
+		name   string
+		path   string
+		ua     string
+		remote string
+		want   int
+		body   string
+	}{
+		{"favicon", "/favicon.ico", "", "203.0.113.1:1234", http.StatusNoContent, ""},
+		{"file", "/robots.txt", "", "203.0.113.1:1234", http.StatusOK, "User-agent: *\nDisallow: /\n"},
+		{"user agent", "/health", "kube-probe/1.30", "203.0.113.1:1234", http.StatusOK, "ok\n"},
+		{"source", "/hello", "", "192.0.2.10:1234", http.StatusForbidden, ""},
+		{"not matched", "/hello", "curl/8.0", "203.0.113.1:1234", http.StatusTeapot, ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.Header.Set("User-Agent", tc.ua)
+			r.RemoteAddr = tc.remote
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tc.want, w.Code)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, w.Body.String())
+			}
+		})
+	}
+	assert.Equal(t, int32(1), process.execs.Load())
+}
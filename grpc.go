@@ -0,0 +1,63 @@
+package saving
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcUnavailable is UNAVAILABLE status code of gRPC that clients retry.
+const grpcUnavailable = 14
+
+// isGRPC reports whether r is a gRPC request.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError writes Trailers-Only gRPC response with UNAVAILABLE status.
+//
+// gRPC clients treat non-200 HTTP status as a protocol error, so errors are sent as gRPC status.
+// Non-zero retryAfter is sent as grpc-retry-pushback-ms.
+func writeGRPCError(w http.ResponseWriter, message string, retryAfter time.Duration) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcUnavailable))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	if retryAfter > 0 {
+		w.Header().Set("Grpc-Retry-Pushback-Ms", strconv.FormatInt(retryAfter.Milliseconds(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes grpc-message header value.
+func encodeGRPCMessage(src string) string {
+	var result strings.Builder
+	for _, b := range []byte(src) {
+		if b < 0x20 || b > 0x7e || b == '%' {
+			fmt.Fprintf(&result, "%%%02X", b)
+		} else {
+			result.WriteByte(b)
+		}
+	}
+	return result.String()
+}
+
+// flushHeaderWriter sends response headers as soon as they are written.
+//
+// httputil.ReverseProxy sends headers with the first body bytes, but clients of
+// streaming RPCs may wait for headers before sending their first message.
+type flushHeaderWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushHeaderWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(code)
+	if code >= http.StatusOK {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w flushHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
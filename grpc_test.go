@@ -0,0 +1,122 @@
+package saving_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving"
+	"github.com/shibukawa/saving/savingtest"
+)
+
+// startGRPCProxy serves the proxy in gRPC mode and returns the h2c client and the proxy URL.
+func startGRPCProxy(t *testing.T, process saving.ProcessController, backend *savingtest.Backend) (*http.Client, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	dest := &url.URL{Scheme: "h2c", Host: backend.URL().Host}
+	saving.ServeProxy(ctx, process, listener, dest, saving.ProxyOption{GRPC: true})
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}, "http://" + listener.Addr().String()
+}
+
+func grpcRequest(t *testing.T, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestGRPCUnary(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	defer backend.Stop()
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{Backend: backend})
+	client, proxyURL := startGRPCProxy(t, process, backend)
+
+	pr, pw := io.Pipe()
+	go func() {
+		savingtest.WriteGRPCMessage(pw, []byte("hello"))
+		pw.Close()
+	}()
+	res, err := client.Do(grpcRequest(t, proxyURL+savingtest.GRPCUnaryMethod, pr))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "HTTP/2.0", res.Proto)
+	msg, err := savingtest.ReadGRPCMessage(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+	_, err = savingtest.ReadGRPCMessage(res.Body)
+	assert.IsError(t, err, io.EOF)
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, 1, process.Boots())
+}
+
+func TestGRPCStreamKeepsProcessAwake(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	defer backend.Stop()
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{
+		Backend:      backend,
+		DrainTimeout: 50 * time.Millisecond,
+	})
+	recorder := savingtest.RecordTransitions(process.Drainable())
+	client, proxyURL := startGRPCProxy(t, process, backend)
+
+	pr, pw := io.Pipe()
+	res, err := client.Do(grpcRequest(t, proxyURL+savingtest.GRPCStreamMethod, pr))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	for _, text := range []string{"first", "second", "third"} {
+		assert.NoError(t, savingtest.WriteGRPCMessage(pw, []byte(text)))
+		msg, err := savingtest.ReadGRPCMessage(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, text, string(msg))
+		// the open stream is in-flight, so the idle process is not drained
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, saving.Waked, process.Status())
+	}
+	pw.Close()
+	_, err = savingtest.ReadGRPCMessage(res.Body)
+	assert.IsError(t, err, io.EOF)
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+
+	recorder.WaitFor(t, saving.Drained, time.Second)
+	assert.Equal(t, 1, process.Boots())
+}
+
+func TestGRPCWakeError(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{
+		BootErrors: []error{saving.ErrHealthCheckFailed},
+	})
+	client, proxyURL := startGRPCProxy(t, process, backend)
+
+	pr, pw := io.Pipe()
+	go func() {
+		savingtest.WriteGRPCMessage(pw, []byte("hello"))
+		pw.Close()
+	}()
+	res, err := client.Do(grpcRequest(t, proxyURL+savingtest.GRPCUnaryMethod, pr))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	// gRPC clients get the status instead of HTTP error
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "14", res.Header.Get("Grpc-Status"))
+	assert.Equal(t, saving.WakeTimeout.String(), res.Header.Get(saving.ErrorKindHeader))
+}
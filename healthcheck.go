@@ -3,28 +3,77 @@ package saving
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/shibukawa/saving/clock"
 )
 
 var ErrOption = errors.New("option error")
 
 func WaitAndCheckHealth(timeout time.Duration, target *url.URL) bool {
-	start := time.Now()
-	initialTicker := time.NewTicker(100 * time.Millisecond)
-	for now := range initialTicker.C {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
-		if res, err := http.DefaultClient.Do(req); err == nil && res.StatusCode == http.StatusOK {
-			initialTicker.Stop()
+	return WaitAndCheckHealthContext(context.Background(), timeout, target)
+}
+
+// WaitAndCheckHealthContext is WaitAndCheckHealth that gives up when ctx is canceled.
+func WaitAndCheckHealthContext(ctx context.Context, timeout time.Duration, target *url.URL) bool {
+	return waitAndCheckHealth(ctx, clock.Real, http.DefaultClient, timeout, target)
+}
+
+// healthCheckClient returns client that uses transport. nil transport means http.DefaultClient.
+func healthCheckClient(transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: transport}
+}
+
+// waitAndCheckHealth polls target with client every 100ms of clk until it returns 200 or timeout passes.
+func waitAndCheckHealth(ctx context.Context, clk clock.Clock, client *http.Client, timeout time.Duration, target *url.URL) bool {
+	start := clk.Now()
+	initialTicker := clk.NewTicker(100 * time.Millisecond)
+	defer initialTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-initialTicker.C():
+		}
+		if checkHealthContext(ctx, client, timeout, target) {
 			return true
-		} else if now.Sub(start) > timeout {
-			break
+		}
+		if clk.Now().Sub(start) > timeout {
+			return false
 		}
 	}
-	return false
+}
+
+// checkHealthContext checks target once. tcp:// target is healthy if it accepts TCP connection,
+// and udp:// target is healthy if a socket is bound to its port.
+func checkHealthContext(ctx context.Context, client *http.Client, timeout time.Duration, target *url.URL) bool {
+	if target.Scheme == "udp" {
+		return checkUDPListening(target)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if target.Scheme == "tcp" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", target.Host)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
 }
 
 func CheckHealth(target *url.URL) bool {
@@ -7,10 +7,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
 )
 
 func init() {
@@ -64,3 +67,46 @@ func TestQuickCheckUnealthy(t *testing.T) {
 	status := WaitAndCheckHealth(time.Second, u)
 	assert.Equal(t, false, status)
 }
+
+func TestCheckHealthTimeoutWithFakeClock(t *testing.T) {
+	port, close := httpStatusCodeServer(t, []int{500})
+	defer close()
+	u, _ := url.Parse(fmt.Sprintf("http://localhost:%d/health", port))
+	clk := clocktest.NewFake(time.Now())
+	result := make(chan bool)
+	go func() {
+		result <- waitAndCheckHealth(context.Background(), clk, http.DefaultClient, time.Second, u)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(500 * time.Millisecond) // checks health, but it is not timeout yet
+	select {
+	case <-result:
+		t.Fatal("finished before timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Second)
+	assert.False(t, <-result)
+}
+
+func TestUDPPortBound(t *testing.T) {
+	content := []byte(`   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  483: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 16824 2 0000000000000000 0
+  628: 00000000:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 19203 2 0000000000000000 0
+`)
+	assert.True(t, udpPortBound(content, 53))
+	assert.True(t, udpPortBound(content, 5353))
+	assert.False(t, udpPortBound(content, 8080))
+	// the remote address is not a bound port
+	assert.False(t, udpPortBound(content, 0))
+}
+
+func TestCheckUDPHealth(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	target := &url.URL{Scheme: "udp", Host: conn.LocalAddr().String()}
+	assert.True(t, checkHealthContext(context.Background(), http.DefaultClient, time.Second, target))
+	conn.Close()
+	if runtime.GOOS == "linux" {
+		assert.False(t, checkHealthContext(context.Background(), http.DefaultClient, time.Second, target))
+	}
+}
@@ -0,0 +1,186 @@
+package saving
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// MemoryCheckInterval is interval to check memory of the server process.
+var MemoryCheckInterval = 5 * time.Second
+
+// MemoryCooldown is duration the memory watcher skips checks after it puts the server process
+// to sleep. It doubles up to MemoryCooldownMax while memory is still over thresholds after the wake.
+var (
+	MemoryCooldown    = time.Minute
+	MemoryCooldownMax = 30 * time.Minute
+)
+
+var ErrParseSize = errors.New("parse size error")
+
+// ParseSize parses size like "512Mi", "1G", "1024k" or "1048576" into bytes.
+func ParseSize(src string) (uint64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(src), "B")
+	units := []struct {
+		suffix string
+		scale  uint64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30},
+		{"k", 1000}, {"K", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000},
+	}
+	scale := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			scale = u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: '%s'", ErrParseSize, src)
+	}
+	return v * scale, nil
+}
+
+// readProcStatus reads value in kB of the key like VmRSS from /proc/<pid>/status in bytes.
+func readProcStatus(pid int, key string) (uint64, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		k, v, found := strings.Cut(scanner.Text(), ":")
+		if !found || k != key {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, fmt.Errorf("%s not found in /proc/%d/status", key, pid)
+}
+
+// pressureFiles are PSI files. cgroup v2 is preferred because it is the container's pressure.
+var pressureFiles = []string{"/sys/fs/cgroup/memory.pressure", "/proc/pressure/memory"}
+
+// readMemoryPressure returns "some avg10" value of memory PSI in percent.
+func readMemoryPressure() (float64, error) {
+	for _, f := range pressureFiles {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		return parsePressure(content)
+	}
+	return 0, errors.New("memory pressure is not available")
+}
+
+func parsePressure(content []byte) (float64, error) {
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if v, found := strings.CutPrefix(field, "avg10="); found {
+				return strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return 0, errors.New("avg10 not found in memory pressure")
+}
+
+// startMemoryWatcher drains the server process early when its RSS or memory pressure crosses thresholds.
+func startMemoryWatcher(ctx context.Context, drainable *Drainable, pid func() int, rssLimit uint64, pressureLimit float64, state *stateRecorder, clk clock.Clock, logger *slog.Logger) {
+	if rssLimit == 0 && pressureLimit == 0 {
+		return
+	}
+	clk = clock.OrReal(clk)
+	w := newMemoryWatcher(drainable, pid, rssLimit, pressureLimit, state, logger)
+	go func() {
+		ticker := clk.NewTicker(MemoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+			}
+			w.check(clk.Now())
+		}
+	}()
+}
+
+type memoryWatcher struct {
+	drainable     *Drainable
+	pid           func() int
+	rssLimit      uint64
+	pressureLimit float64
+	state         *stateRecorder
+	logger        *slog.Logger
+	cooldown      time.Duration
+	resume        time.Time // checks are skipped until this time after sleep
+}
+
+func newMemoryWatcher(drainable *Drainable, pid func() int, rssLimit uint64, pressureLimit float64, state *stateRecorder, logger *slog.Logger) *memoryWatcher {
+	return &memoryWatcher{
+		drainable:     drainable,
+		pid:           pid,
+		rssLimit:      rssLimit,
+		pressureLimit: pressureLimit,
+		state:         state,
+		logger:        logger,
+		cooldown:      MemoryCooldown,
+	}
+}
+
+// check puts the server process to sleep if memory is over thresholds, and reports whether it did.
+func (w *memoryWatcher) check(now time.Time) bool {
+	if w.drainable.Status() != Waked || now.Before(w.resume) {
+		return false
+	}
+	var reason string
+	var attr slog.Attr
+	if w.rssLimit > 0 {
+		if rss, err := readProcStatus(w.pid(), "VmRSS"); err == nil && rss > w.rssLimit {
+			reason = "rss"
+			attr = slog.Uint64("rss", rss)
+		}
+	}
+	if reason == "" && w.pressureLimit > 0 {
+		if pressure, err := readMemoryPressure(); err == nil && pressure > w.pressureLimit {
+			reason = "memory pressure"
+			attr = slog.Float64("avg10", pressure)
+		}
+	}
+	if reason == "" {
+		w.cooldown = MemoryCooldown
+		return false
+	}
+	// Sleep doesn't wait for holds of schedules, so the process drains unless draining already started
+	if !w.drainable.Sleep() {
+		return false
+	}
+	// sustained pressure would repeat wake and sleep, so the next sleep waits longer
+	w.logger.Warn("sleep by memory", slog.String("reason", reason), attr, slog.Duration("cooldown", w.cooldown))
+	w.state.update(func(s *State) {
+		s.SleepReason = reason
+		s.SleptAt = now
+	})
+	w.resume = now.Add(w.cooldown)
+	w.cooldown = min(w.cooldown*2, MemoryCooldownMax)
+	return true
+}
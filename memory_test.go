@@ -0,0 +1,144 @@
+package saving
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+func TestParseSize(t *testing.T) {
+	testcases := []struct {
+		src  string
+		want uint64
+	}{
+		{"1024", 1024},
+		{"512Mi", 512 << 20},
+		{"512MiB", 512 << 20},
+		{"1G", 1000 * 1000 * 1000},
+		{"64k", 64000},
+	}
+	for _, tc := range testcases {
+		v, err := ParseSize(tc.src)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, v)
+	}
+	_, err := ParseSize("large")
+	assert.IsError(t, err, ErrParseSize)
+}
+
+func TestParsePressure(t *testing.T) {
+	v, err := parsePressure([]byte("some avg10=12.50 avg60=3.00 avg300=0.50 total=12345\nfull avg10=1.00 avg60=0.00 avg300=0.00 total=123\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 12.5, v)
+	_, err = parsePressure([]byte(""))
+	assert.Error(t, err)
+}
+
+func TestReadRSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("procfs is not available")
+	}
+	rss, err := readProcStatus(os.Getpid(), "VmRSS")
+	assert.NoError(t, err)
+	assert.True(t, rss > 0)
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	r := newStateRecorder(path)
+	state, err := ReadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Drained", state.Status)
+
+	r.update(func(s *State) {
+		s.Status = Waked.GoString()
+		s.SleepReason = "rss"
+	})
+	state, err = ReadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Waked", state.Status)
+	assert.Equal(t, "rss", state.SleepReason)
+
+	r.remove()
+	_, err = ReadState(path)
+	assert.Error(t, err)
+}
+
+func TestMemoryWatcherCooldown(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("procfs is not available")
+	}
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(wait(0), wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	// RSS of this process is always over the limit
+	w := newMemoryWatcher(drainable, os.Getpid, 1, 0, nil, slog.Default())
+	start := clk.Now()
+
+	// sleeps at the first check
+	assert.NoError(t, drainable.Exec(func() {}))
+	assert.True(t, w.check(start))
+	clk.Advance(0)
+	assert.Equal(t, Drained, drainable.Status())
+
+	// the fresh process is not checked during the cooldown
+	assert.NoError(t, drainable.Exec(func() {}))
+	assert.False(t, w.check(start.Add(MemoryCooldown-time.Second)))
+	assert.True(t, w.check(start.Add(MemoryCooldown)))
+	clk.Advance(0)
+
+	// the cooldown doubles while memory is still over the limit
+	assert.NoError(t, drainable.Exec(func() {}))
+	assert.False(t, w.check(start.Add(3*MemoryCooldown-time.Second)))
+	assert.True(t, w.check(start.Add(3*MemoryCooldown)))
+	clk.Advance(0)
+	assert.Equal(t, 8*MemoryCooldown, w.cooldown)
+
+	// memory under the limit resets the cooldown
+	assert.NoError(t, drainable.Exec(func() {}))
+	w.rssLimit = 1 << 62
+	assert.False(t, w.check(start.Add(time.Hour)))
+	assert.Equal(t, MemoryCooldown, w.cooldown)
+}
+
+func TestMemoryWatcherWhileHeld(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("procfs is not available")
+	}
+	var boots atomic.Int32
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(func() error {
+		boots.Add(1)
+		return nil
+	}, wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	state := newStateRecorder(filepath.Join(t.TempDir(), "state.json"))
+	w := newMemoryWatcher(drainable, os.Getpid, 1, 0, state, slog.Default())
+	release, err := drainable.Hold()
+	assert.NoError(t, err)
+	defer release()
+
+	// memory sleep overrides the hold of the schedule, and the hold moves to the fresh process
+	assert.True(t, w.check(clk.Now()))
+	waitTimers(t, clk, 1)
+	clk.Advance(0)
+	waitTimers(t, clk, 0)
+	assert.Equal(t, Waked, drainable.Status())
+	assert.Equal(t, int32(2), boots.Load())
+	assert.Equal(t, "rss", state.state.SleepReason)
+
+	// sleep requested by others is not reported as sleep by memory
+	state.update(func(s *State) { s.SleepReason = "" })
+	assert.True(t, drainable.Sleep())
+	cooldown := w.cooldown
+	assert.False(t, w.check(clk.Now().Add(time.Hour)))
+	assert.Equal(t, cooldown, w.cooldown)
+	assert.Equal(t, "", state.state.SleepReason)
+}
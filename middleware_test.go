@@ -0,0 +1,109 @@
+package saving_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving"
+	"github.com/shibukawa/saving/savingtest"
+)
+
+func TestMiddleware(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	defer backend.Stop()
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{Backend: backend})
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", saving.Middleware(process, saving.ProxyOption{
+		LivenessPath: "/api/livez",
+	})(httputil.NewSingleHostReverseProxy(backend.URL())))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "gateway")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) string {
+		res, err := http.Get(server.URL + path)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+	assert.Equal(t, "gateway", get("/"))
+	assert.Equal(t, "ok\n", get("/api/livez"))
+	assert.Equal(t, saving.Drained, process.Status())
+	assert.Equal(t, "hello from /api/hello", get("/api/hello"))
+	assert.Equal(t, saving.Waked, process.Status())
+	assert.Equal(t, 1, process.Boots())
+}
+
+// minimalProcess implements only the methods ProcessController requires.
+type minimalProcess struct {
+	pid int
+}
+
+func (p *minimalProcess) Exec(callback func()) error {
+	p.pid = 1
+	callback()
+	return nil
+}
+
+func (p *minimalProcess) IsWaking() bool {
+	return false
+}
+
+func (p *minimalProcess) Pid() int {
+	return p.pid
+}
+
+func TestMiddlewareWithMinimalProcess(t *testing.T) {
+	process := &minimalProcess{}
+	handler := saving.Middleware(process, saving.ProxyOption{ReadinessPath: "/readyz"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Body.String()
+	}
+	// the status comes from Pid without StatusReporter
+	assert.Equal(t, "ready: Drained\n", get("/readyz"))
+	assert.Equal(t, "hello", get("/"))
+	assert.Equal(t, "ready: Waked\n", get("/readyz"))
+}
+
+func ExampleNewHandler() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	process, err := saving.NewExecKillProcessController(ctx, saving.ProcessOption{
+		PidPath:        saving.NormalizePidPath(""),
+		HealthCheckUrl: mustParse("http://localhost:8080/health"),
+		WakeTimeout:    10 * time.Second,
+		DrainTimeout:   time.Minute,
+		Cmd:            "./server",
+	})
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/app/", saving.NewHandler(process, mustParse("http://localhost:8080"), saving.ProxyOption{}))
+	http.ListenAndServe(":80", mux)
+}
+
+func mustParse(src string) *url.URL {
+	u, err := url.Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
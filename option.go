@@ -1,47 +1,99 @@
 package saving
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	texttemplate "text/template"
 	"time"
+
+	"github.com/shibukawa/saving/clock"
 )
 
 const DefaultPidFilename = "SAVING_PID"
 const DefaultCriuDumpFilename = "saving.dump"
 
 type PortMap struct {
-	FromPort    string
-	Destination *url.URL
+	FromPort      string // Listening address like ":8080", or unix domain socket like "unix:/run/app.sock"
+	Destination   *url.URL
+	Listener      net.Listener   // Pre-opened listener like an inherited socket. FromPort is not bound if it is set
+	TLS           bool           // Terminate TLS on this port with Option.TLS
+	GRPC          bool           // Accept h2c and stream responses for gRPC on this port
+	ProxyProtocol bool           // Read PROXY protocol header on this port
+	PacketConn    net.PacketConn // Pre-opened UDP socket for udp upstreams. FromPort is not bound if it is set
 }
 
 type Option struct {
-	HealthCheckUrl     *url.URL      // Health check URL
-	WakeTimeout        time.Duration // Timeout duration to wait before scaling up the backend server
-	DrainTimeout       time.Duration // Timeout duration to wait before scaling down the backend server
-	HealthCheckTimeout time.Duration // Timeout duration to wait oneshot health check request
-	PortMaps           []PortMap     // map of listening port to destination
-	Logger             *slog.Logger  // Logger
-	Cmd                string        // Command to execute
-	Args               []string      // Command args
-	PidPath            string        // Pid file that stores the process ID
-	CriuPath           string        // CRIU command path and use it to control process
-	CriuDumpPath       string        // CRIU dump path to store process information
+	HealthCheckUrl        *url.URL               // Health check URL
+	WakeTimeout           time.Duration          // Timeout duration to wait before scaling up the backend server
+	DrainTimeout          time.Duration          // Timeout duration to wait before scaling down the backend server
+	DrainPolicy           string                 // "fixed" or "adaptive"
+	DrainTimeoutMin       time.Duration          // Lower bound of adaptive drain timeout
+	DrainTimeoutMax       time.Duration          // Upper bound of adaptive drain timeout
+	HealthCheckTimeout    time.Duration          // Timeout duration to wait oneshot health check request
+	PortMaps              []PortMap              // map of listening port to destination
+	Logger                *slog.Logger           // Logger
+	Cmd                   string                 // Command to execute
+	Args                  []string               // Command args
+	PidPath               string                 // Pid file that stores the process ID
+	CriuPath              string                 // CRIU command path and use it to control process
+	CriuDumpPath          string                 // CRIU dump path to store process information
+	LivenessPath          string                 // Path of built-in liveness endpoint on listening ports
+	ReadinessPath         string                 // Path of built-in readiness endpoint on listening ports
+	WaitingPage           *template.Template     // Page for HTML requests while the backend server is waking
+	RetryAfter            time.Duration          // Return 503 with Retry-After to API requests while the backend server is waking
+	ErrorPage             *template.Template     // HTML error page template
+	ErrorJson             *texttemplate.Template // JSON error body template
+	ExemptRules           []ExemptRule           // Rules for requests answered without waking the backend server
+	Cache                 bool                   // Cache GET responses that Cache-Control allows
+	CacheMaxStale         time.Duration          // Serve stale cached responses within this duration while the backend server is sleeping
+	CachePath             string                 // File to persist cached responses
+	CacheSize             uint64                 // Total body size of cached responses. 0 means DefaultCacheSize
+	CacheMaxBodySize      uint64                 // Body size of each cached response. 0 means DefaultCacheBodySize
+	StaticDir             string                 // Directory of static files served without waking the backend server
+	WakeLimitBurst        int                    // Count of wakes each source can trigger per WakeLimitPer
+	WakeLimitPer          time.Duration          // Duration to refill WakeLimitBurst
+	WakeAllow             []*net.IPNet           // Sources that can wake the backend server (empty means any)
+	WakeDeny              []*net.IPNet           // Sources that can't wake the backend server
+	AwakeSchedules        []*Schedule            // Keep the backend server awake during these schedules
+	PreWake               time.Duration          // Wake the backend server before the schedules start
+	SleepOutside          bool                   // Sleep the backend server as soon as the schedules end
+	MaxAwake              time.Duration          // Recycle the backend server after this awake duration
+	MaxRequests           uint64                 // Recycle the backend server after this count of requests
+	StatePath             string                 // State file for monitoring
+	MemoryLimit           uint64                 // Sleep the backend server early when its RSS exceeds this bytes
+	MemoryPressure        float64                // Sleep the backend server early when memory pressure (PSI some avg10) exceeds this percent
+	MaxQueued             int                    // Max count of requests waiting for wake (0 means unlimited)
+	MaxQueueWait          time.Duration          // Max duration requests wait for wake (0 means unlimited)
+	CancelAbandonedWake   bool                   // Stop waking the backend server when all clients waiting for it disconnect
+	TLS                   TLSOption              // Certificates for ports with PortMap.TLS
+	Upstream              UpstreamOption         // Connection settings to https upstreams
+	UnixSocketMode        os.FileMode            // Permission of listening unix sockets. 0 means umask
+	ProxyProtocolTrusted  []*net.IPNet           // Sources that can send PROXY protocol header (empty means any)
+	ProxyProtocolUpstream int                    // Version of PROXY protocol header sent to tcp upstreams. 0 means none
+	HealthCheckTransport  http.RoundTripper      // Transport for health check. nil means http.DefaultTransport
+	UDPFlowTimeout        time.Duration          // Keep UDP flow of each client without datagrams for this duration
+	UDPMaxFlows           int                    // Max count of UDP flows of each port. Datagrams of new clients over it are dropped
 }
 
 var ErrParseOption = errors.New("parse option error")
 
 func InitOption(args []string) (*Option, error) {
 	result := &Option{
-		PidPath: NormalizePidPath(os.Getenv("SAVING_PID_PATH")),
+		PidPath:   NormalizePidPath(os.Getenv("SAVING_PID_PATH")),
+		StatePath: NormalizeStatePath(os.Getenv("SAVING_STATE_PATH")),
 	}
 	if len(args) > 0 {
 		result.Cmd = args[0]
@@ -54,6 +106,28 @@ func InitOption(args []string) (*Option, error) {
 	} else {
 		result.DrainTimeout = drainTimeout
 	}
+	result.DrainPolicy = os.Getenv("SAVING_DRAIN_POLICY")
+	if result.DrainPolicy == "" {
+		result.DrainPolicy = "fixed"
+	}
+	if _, err := NewDrainPolicy(result.DrainPolicy, 0, 0, 0); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_DRAIN_POLICY should be 'fixed' or 'adaptive': '%s'", ErrParseOption, result.DrainPolicy))
+	}
+	if result.DrainPolicy == "adaptive" {
+		// bounds are used only by adaptive policy
+		if drainTimeoutMin, valid := NormalizeDuration(os.Getenv("SAVING_DRAIN_TIMEOUT_MIN"), 10*time.Second); !valid {
+			errs = append(errs, fmt.Errorf("%w: SAVING_DRAIN_TIMEOUT_MIN is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_DRAIN_TIMEOUT_MIN")))
+		} else {
+			result.DrainTimeoutMin = drainTimeoutMin
+		}
+		if drainTimeoutMax, valid := NormalizeDuration(os.Getenv("SAVING_DRAIN_TIMEOUT_MAX"), 10*time.Minute); !valid {
+			errs = append(errs, fmt.Errorf("%w: SAVING_DRAIN_TIMEOUT_MAX is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_DRAIN_TIMEOUT_MAX")))
+		} else if drainTimeoutMax < result.DrainTimeoutMin {
+			errs = append(errs, fmt.Errorf("%w: SAVING_DRAIN_TIMEOUT_MAX should be longer than SAVING_DRAIN_TIMEOUT_MIN: '%s'", ErrParseOption, os.Getenv("SAVING_DRAIN_TIMEOUT_MAX")))
+		} else {
+			result.DrainTimeoutMax = drainTimeoutMax
+		}
+	}
 	if wakeTimeout, valid := NormalizeDuration(os.Getenv("SAVING_WAKE_TIMEOUT"), 10*time.Second); !valid {
 		errs = append(errs, fmt.Errorf("%w: SAVING_WAKE_TIMEOUT is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_WAKE_TIMEOUT")))
 
@@ -66,33 +140,122 @@ func InitOption(args []string) (*Option, error) {
 		if strings.TrimSpace(portMap) == "" {
 			continue
 		}
-		ports := strings.Split(portMap, ":")
-		if len(ports) != 2 {
+		portMap = strings.TrimSpace(portMap)
+		// unix socket path of the listening side ends at the next colon
+		socketPath, isUnix := strings.CutPrefix(portMap, unixSocketPrefix)
+		if isUnix {
+			portMap = socketPath
+		}
+		listen, target, found := strings.Cut(portMap, ":")
+		if !found {
 			errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: format error: '%s'", ErrParseOption, portMap))
 			continue
 		} else {
-			var listenPort, targetPort uint16
-			lp, err := strconv.ParseUint(ports[0], 10, 16)
-			if err != nil || lp < 1 || lp > 65535 {
-				errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: listen port should be 1-65535: '%d'", ErrParseOption, lp))
+			var fromPort string
+			if isUnix {
+				if listen == "" {
+					errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: listen socket path is empty", ErrParseOption))
+				} else {
+					fromPort = unixSocketPrefix + listen
+				}
+			} else if lp, err := strconv.ParseUint(listen, 10, 16); err != nil || lp < 1 || lp > 65535 {
+				errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: listen port should be 1-65535: '%s'", ErrParseOption, listen))
 			} else {
-				listenPort = uint16(lp)
+				fromPort = ":" + strconv.Itoa(int(lp))
 			}
-			tp, err := strconv.ParseUint(ports[1], 10, 16)
-			if err != nil || tp < 1 || tp > 65535 {
-				errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: target port should be 1-65535: '%d'", ErrParseOption, tp))
-			} else {
-				targetPort = uint16(tp)
+			u, err := ParseUpstream(target)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: %w", ErrParseOption, err))
+			}
+			if isUnix && u != nil && u.Scheme == "udp" {
+				errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS: udp upstream can't listen on unix domain socket: '%s'", ErrParseOption, portMap))
+			} else if fromPort != "" && u != nil {
+				result.PortMaps = append(result.PortMaps, PortMap{FromPort: fromPort, Destination: u})
 			}
-			if listenPort != 0 && targetPort != 0 {
-				u, _ := url.Parse("http://localhost:" + strconv.Itoa(int(targetPort)))
-				result.PortMaps = append(result.PortMaps, PortMap{":" + strconv.Itoa(int(listenPort)), u})
+		}
+	}
+	if caFile := os.Getenv("SAVING_UPSTREAM_CA_FILE"); caFile != "" {
+		if pem, err := os.ReadFile(caFile); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_UPSTREAM_CA_FILE: %w", ErrParseOption, err))
+		} else {
+			result.Upstream.RootCAs = x509.NewCertPool()
+			if !result.Upstream.RootCAs.AppendCertsFromPEM(pem) {
+				errs = append(errs, fmt.Errorf("%w: SAVING_UPSTREAM_CA_FILE: no certificates in '%s'", ErrParseOption, caFile))
 			}
 		}
 	}
+	result.Upstream.InsecureSkipVerify = NormalizeBool(os.Getenv("SAVING_UPSTREAM_INSECURE_SKIP_VERIFY"))
 	if len(result.PortMaps) == 0 {
 		errs = append(errs, fmt.Errorf("%w: SAVING_PORT_MAPS env var is required, but empty", ErrParseOption))
 	}
+	if tlsPorts := splitList(os.Getenv("SAVING_TLS_PORTS")); len(tlsPorts) > 0 {
+		for _, port := range tlsPorts {
+			i := findPortMap(result.PortMaps, port)
+			if i < 0 {
+				errs = append(errs, fmt.Errorf("%w: SAVING_TLS_PORTS: port is not in SAVING_PORT_MAPS: '%s'", ErrParseOption, port))
+				continue
+			}
+			if result.PortMaps[i].Destination.Scheme == "udp" {
+				errs = append(errs, fmt.Errorf("%w: SAVING_TLS_PORTS: port %s relays UDP", ErrParseOption, port))
+				continue
+			}
+			result.PortMaps[i].TLS = true
+		}
+		result.TLS = TLSOption{
+			CertFiles:    splitList(os.Getenv("SAVING_TLS_CERT_FILE")),
+			KeyFiles:     splitList(os.Getenv("SAVING_TLS_KEY_FILE")),
+			ClientCAFile: os.Getenv("SAVING_TLS_CLIENT_CA_FILE"),
+		}
+		if len(result.TLS.CertFiles) == 0 || len(result.TLS.CertFiles) != len(result.TLS.KeyFiles) {
+			errs = append(errs, fmt.Errorf("%w: SAVING_TLS_CERT_FILE and SAVING_TLS_KEY_FILE should have same count of files", ErrParseOption))
+		}
+	}
+	for _, port := range splitList(os.Getenv("SAVING_GRPC_PORTS")) {
+		i := findPortMap(result.PortMaps, port)
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_GRPC_PORTS: port is not in SAVING_PORT_MAPS: '%s'", ErrParseOption, port))
+		} else if scheme := result.PortMaps[i].Destination.Scheme; scheme != "h2c" && scheme != "https" {
+			errs = append(errs, fmt.Errorf("%w: SAVING_GRPC_PORTS: upstream of port %s should be h2c or https for HTTP/2", ErrParseOption, port))
+		} else {
+			result.PortMaps[i].GRPC = true
+		}
+	}
+	for _, port := range splitList(os.Getenv("SAVING_PROXY_PROTOCOL_PORTS")) {
+		if i := findPortMap(result.PortMaps, port); i < 0 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_PROXY_PROTOCOL_PORTS: port is not in SAVING_PORT_MAPS: '%s'", ErrParseOption, port))
+		} else if result.PortMaps[i].Destination.Scheme == "udp" {
+			errs = append(errs, fmt.Errorf("%w: SAVING_PROXY_PROTOCOL_PORTS: port %s relays UDP", ErrParseOption, port))
+		} else {
+			result.PortMaps[i].ProxyProtocol = true
+		}
+	}
+	if trusted, err := ParseCIDRs(os.Getenv("SAVING_PROXY_PROTOCOL_TRUSTED")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_PROXY_PROTOCOL_TRUSTED: %w", ErrParseOption, err))
+	} else {
+		result.ProxyProtocolTrusted = trusted
+	}
+	switch version := os.Getenv("SAVING_PROXY_PROTOCOL_UPSTREAM"); version {
+	case "":
+	case "v1":
+		result.ProxyProtocolUpstream = 1
+	case "v2":
+		result.ProxyProtocolUpstream = 2
+	default:
+		errs = append(errs, fmt.Errorf("%w: SAVING_PROXY_PROTOCOL_UPSTREAM should be v1 or v2: '%s'", ErrParseOption, version))
+	}
+	if udpFlowTimeout, valid := NormalizeDuration(os.Getenv("SAVING_UDP_FLOW_TIMEOUT"), DefaultUDPFlowTimeout); !valid || udpFlowTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_UDP_FLOW_TIMEOUT is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_UDP_FLOW_TIMEOUT")))
+	} else {
+		result.UDPFlowTimeout = udpFlowTimeout
+	}
+	result.UDPMaxFlows = DefaultUDPMaxFlows
+	if maxFlows := os.Getenv("SAVING_UDP_MAX_FLOWS"); maxFlows != "" {
+		if m, err := strconv.Atoi(maxFlows); err != nil || m < 1 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_UDP_MAX_FLOWS should be positive number: '%s'", ErrParseOption, maxFlows))
+		} else {
+			result.UDPMaxFlows = m
+		}
+	}
 	healthCheckUrl := &url.URL{
 		Scheme: "http",
 		Path:   os.Getenv("SAVING_HEALTH_CHECK_PATH"),
@@ -100,17 +263,173 @@ func InitOption(args []string) (*Option, error) {
 	if healthCheckUrl.Path == "" {
 		healthCheckUrl.Path = "/health"
 	}
-	healthCheckPort := os.Getenv("SAVING_HEALTH_CHECK_PORT")
-	if healthCheckPort == "" {
-		if len(result.PortMaps) > 0 {
-			healthCheckUrl.Host = result.PortMaps[0].Destination.Host
-		}
+	// health check uses the scheme of the first upstream
+	healthCheckDest := &url.URL{Scheme: "http"}
+	if len(result.PortMaps) > 0 {
+		healthCheckDest = result.PortMaps[0].Destination
+	}
+	if healthCheckPort := os.Getenv("SAVING_HEALTH_CHECK_PORT"); healthCheckPort == "" {
+		// use the first upstream
 	} else if p, err := strconv.ParseUint(healthCheckPort, 10, 16); err != nil || p == 0 {
 		errs = append(errs, fmt.Errorf("%w: SAVING_HEALTH_CHECK_PORT: port should be 1-65535: '%s'", ErrParseOption, healthCheckPort))
 	} else {
-		healthCheckUrl.Host = net.JoinHostPort("localhost", healthCheckPort)
+		healthCheckDest = &url.URL{Scheme: healthCheckDest.Scheme, Host: net.JoinHostPort("localhost", healthCheckPort)}
+		if healthCheckDest.Scheme == "unix" {
+			healthCheckDest.Scheme = "http"
+		}
+	}
+	if healthCheckDest.Scheme == "http" {
+		healthCheckUrl.Host = healthCheckDest.Host
+	} else if healthCheckDest.Scheme == "tcp" || healthCheckDest.Scheme == "udp" {
+		// raw TCP and UDP servers may not speak HTTP
+		healthCheckUrl = &url.URL{Scheme: healthCheckDest.Scheme, Host: healthCheckDest.Host}
+	} else {
+		transport, target := NewUpstreamTransport(healthCheckDest, result.Upstream)
+		healthCheckUrl.Scheme = target.Scheme
+		healthCheckUrl.Host = target.Host
+		result.HealthCheckTransport = transport
 	}
 	result.HealthCheckUrl = healthCheckUrl
+	if livenessPath := os.Getenv("SAVING_LIVENESS_PATH"); livenessPath != "" && !strings.HasPrefix(livenessPath, "/") {
+		errs = append(errs, fmt.Errorf("%w: SAVING_LIVENESS_PATH: path should start with '/': '%s'", ErrParseOption, livenessPath))
+	} else {
+		result.LivenessPath = livenessPath
+	}
+	if readinessPath := os.Getenv("SAVING_READINESS_PATH"); readinessPath != "" && !strings.HasPrefix(readinessPath, "/") {
+		errs = append(errs, fmt.Errorf("%w: SAVING_READINESS_PATH: path should start with '/': '%s'", ErrParseOption, readinessPath))
+	} else {
+		result.ReadinessPath = readinessPath
+	}
+	if waitingPage := os.Getenv("SAVING_WAITING_PAGE"); waitingPage != "" {
+		if t, err := LoadWaitingPage(waitingPage); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_WAITING_PAGE: %s", ErrParseOption, err.Error()))
+		} else {
+			result.WaitingPage = t
+		}
+	}
+	if retryAfter, valid := NormalizeDuration(os.Getenv("SAVING_RETRY_AFTER"), 0); !valid || retryAfter < 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_RETRY_AFTER is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_RETRY_AFTER")))
+	} else {
+		result.RetryAfter = retryAfter
+	}
+	if errorPage, err := LoadErrorPage(os.Getenv("SAVING_ERROR_PAGE")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_ERROR_PAGE: %s", ErrParseOption, err.Error()))
+	} else {
+		result.ErrorPage = errorPage
+	}
+	if errorJson, err := LoadErrorJson(os.Getenv("SAVING_ERROR_JSON")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_ERROR_JSON: %s", ErrParseOption, err.Error()))
+	} else {
+		result.ErrorJson = errorJson
+	}
+	if exemptRules, err := ParseExemptRules(os.Getenv("SAVING_EXEMPT_RULES")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_EXEMPT_RULES: %w", ErrParseOption, err))
+	} else {
+		result.ExemptRules = exemptRules
+	}
+	result.Cache = NormalizeBool(os.Getenv("SAVING_CACHE"))
+	if cacheMaxStale, valid := NormalizeDuration(os.Getenv("SAVING_CACHE_MAX_STALE"), 0); !valid || cacheMaxStale < 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_CACHE_MAX_STALE is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_CACHE_MAX_STALE")))
+	} else {
+		result.CacheMaxStale = cacheMaxStale
+	}
+	result.CachePath = os.Getenv("SAVING_CACHE_PATH")
+	if cacheSize := os.Getenv("SAVING_CACHE_SIZE"); cacheSize != "" {
+		if size, err := ParseSize(cacheSize); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_CACHE_SIZE: %w", ErrParseOption, err))
+		} else {
+			result.CacheSize = size
+		}
+	}
+	if cacheMaxBodySize := os.Getenv("SAVING_CACHE_MAX_BODY_SIZE"); cacheMaxBodySize != "" {
+		if size, err := ParseSize(cacheMaxBodySize); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_CACHE_MAX_BODY_SIZE: %w", ErrParseOption, err))
+		} else {
+			result.CacheMaxBodySize = size
+		}
+	}
+	if staticDir := os.Getenv("SAVING_STATIC_DIR"); staticDir != "" {
+		if stat, err := os.Stat(staticDir); err != nil || !stat.IsDir() {
+			errs = append(errs, fmt.Errorf("%w: SAVING_STATIC_DIR: directory not found: '%s'", ErrParseOption, staticDir))
+		} else {
+			result.StaticDir = staticDir
+		}
+	}
+	if wakeLimit := os.Getenv("SAVING_WAKE_LIMIT"); wakeLimit != "" {
+		if burst, per, err := ParseWakeLimit(wakeLimit); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_WAKE_LIMIT: %w", ErrParseOption, err))
+		} else {
+			result.WakeLimitBurst = burst
+			result.WakeLimitPer = per
+		}
+	}
+	if wakeAllow, err := ParseCIDRs(os.Getenv("SAVING_WAKE_ALLOW")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_WAKE_ALLOW: %w", ErrParseOption, err))
+	} else {
+		result.WakeAllow = wakeAllow
+	}
+	if wakeDeny, err := ParseCIDRs(os.Getenv("SAVING_WAKE_DENY")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_WAKE_DENY: %w", ErrParseOption, err))
+	} else {
+		result.WakeDeny = wakeDeny
+	}
+	if schedules, err := ParseSchedules(os.Getenv("SAVING_AWAKE_SCHEDULE")); err != nil {
+		errs = append(errs, fmt.Errorf("%w: SAVING_AWAKE_SCHEDULE: %w", ErrParseOption, err))
+	} else {
+		result.AwakeSchedules = schedules
+	}
+	if preWake, valid := NormalizeDuration(os.Getenv("SAVING_PRE_WAKE"), 0); !valid || preWake < 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_PRE_WAKE is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_PRE_WAKE")))
+	} else {
+		result.PreWake = preWake
+	}
+	result.SleepOutside = NormalizeBool(os.Getenv("SAVING_SLEEP_OUTSIDE_SCHEDULE"))
+	if maxAwake, valid := NormalizeDuration(os.Getenv("SAVING_MAX_AWAKE"), 0); !valid || maxAwake < 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_MAX_AWAKE is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_MAX_AWAKE")))
+	} else {
+		result.MaxAwake = maxAwake
+	}
+	if maxRequests := os.Getenv("SAVING_MAX_REQUESTS"); maxRequests != "" {
+		if m, err := strconv.ParseUint(maxRequests, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_MAX_REQUESTS is invalid: '%s'", ErrParseOption, maxRequests))
+		} else {
+			result.MaxRequests = m
+		}
+	}
+	if memoryLimit := os.Getenv("SAVING_MEMORY_LIMIT"); memoryLimit != "" {
+		if m, err := ParseSize(memoryLimit); err != nil {
+			errs = append(errs, fmt.Errorf("%w: SAVING_MEMORY_LIMIT: %w", ErrParseOption, err))
+		} else {
+			result.MemoryLimit = m
+		}
+	}
+	if memoryPressure := os.Getenv("SAVING_MEMORY_PRESSURE"); memoryPressure != "" {
+		if m, err := strconv.ParseFloat(memoryPressure, 64); err != nil || m <= 0 || m > 100 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_MEMORY_PRESSURE should be 0-100: '%s'", ErrParseOption, memoryPressure))
+		} else {
+			result.MemoryPressure = m
+		}
+	}
+	if maxQueued := os.Getenv("SAVING_MAX_QUEUED"); maxQueued != "" {
+		if m, err := strconv.Atoi(maxQueued); err != nil || m < 0 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_MAX_QUEUED is invalid: '%s'", ErrParseOption, maxQueued))
+		} else {
+			result.MaxQueued = m
+		}
+	}
+	if maxQueueWait, valid := NormalizeDuration(os.Getenv("SAVING_MAX_QUEUE_WAIT"), 0); !valid || maxQueueWait < 0 {
+		errs = append(errs, fmt.Errorf("%w: SAVING_MAX_QUEUE_WAIT is invalid: '%s'", ErrParseOption, os.Getenv("SAVING_MAX_QUEUE_WAIT")))
+	} else {
+		result.MaxQueueWait = maxQueueWait
+	}
+	result.CancelAbandonedWake = NormalizeBool(os.Getenv("SAVING_CANCEL_ABANDONED_WAKE"))
+	if socketMode := os.Getenv("SAVING_UNIX_SOCKET_MODE"); socketMode != "" {
+		if mode, err := strconv.ParseUint(socketMode, 8, 32); err != nil || mode > 0o777 {
+			errs = append(errs, fmt.Errorf("%w: SAVING_UNIX_SOCKET_MODE should be octal permission like 0660: '%s'", ErrParseOption, socketMode))
+		} else {
+			result.UnixSocketMode = os.FileMode(mode)
+		}
+	}
 	if runtime.GOOS == "linux" {
 		criuPath := os.Getenv("SAVING_CRIU_PATH")
 		if criuPath != "" {
@@ -120,6 +439,10 @@ func InitOption(args []string) (*Option, error) {
 			} else {
 				result.CriuPath = criuPath
 			}
+			// criu restores the same process from the dump, so recycling doesn't refresh it
+			if result.MaxAwake > 0 || result.MaxRequests > 0 {
+				errs = append(errs, fmt.Errorf("%w: SAVING_MAX_AWAKE and SAVING_MAX_REQUESTS are not available with SAVING_CRIU_PATH", ErrParseOption))
+			}
 		}
 		result.CriuDumpPath = os.Getenv("SAVING_CRIU_DUMP_PATH")
 		if result.CriuDumpPath == "" {
@@ -133,6 +456,24 @@ func InitOption(args []string) (*Option, error) {
 	return result, nil
 }
 
+// findPortMap returns index of the port map that listens on port like "8080" or "unix:/run/app.sock", or -1.
+func findPortMap(portMaps []PortMap, port string) int {
+	return slices.IndexFunc(portMaps, func(p PortMap) bool {
+		return p.FromPort == ":"+port || p.FromPort == port && strings.HasPrefix(port, unixSocketPrefix)
+	})
+}
+
+// splitList splits comma separated list and drops empty items.
+func splitList(src string) []string {
+	var result []string
+	for _, s := range strings.Split(src, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 func NormalizePidPath(pidPath string) string {
 	if pidPath == "" {
 		return filepath.Join(os.TempDir(), DefaultPidFilename)
@@ -151,29 +492,124 @@ func NormalizeDuration(src string, defaultValue time.Duration) (time.Duration, b
 	return result, true
 }
 
+// NormalizeBool accepts yes/on/true/1 as true like SAVING_SLOG_ADD_SOURCE.
+func NormalizeBool(src string) bool {
+	switch strings.ToLower(src) {
+	case "", "0", "off", "false", "no":
+		return false
+	default:
+		return true
+	}
+}
+
 type ProcessOption struct {
-	PidPath            string
-	HealthCheckUrl     *url.URL
-	WakeTimeout        time.Duration
-	DrainTimeout       time.Duration
-	HealthCheckTimeout time.Duration
-	Cmd                string
-	Args               []string
-	Logger             *slog.Logger
-	CriuPath           string
-	CriuDumpPath       string
+	PidPath              string
+	HealthCheckUrl       *url.URL
+	WakeTimeout          time.Duration
+	DrainTimeout         time.Duration
+	DrainPolicy          string
+	DrainTimeoutMin      time.Duration
+	DrainTimeoutMax      time.Duration
+	HealthCheckTimeout   time.Duration
+	Cmd                  string
+	Args                 []string
+	Logger               *slog.Logger
+	CriuPath             string
+	CriuDumpPath         string
+	AwakeSchedules       []*Schedule
+	PreWake              time.Duration
+	SleepOutside         bool
+	MaxAwake             time.Duration
+	MaxRequests          uint64
+	StatePath            string
+	MemoryLimit          uint64
+	MemoryPressure       float64
+	MaxQueued            int
+	MaxQueueWait         time.Duration
+	CancelAbandonedWake  bool
+	HealthCheckTransport http.RoundTripper // Transport for health check. nil means http.DefaultTransport
+	Clock                clock.Clock       // Clock for timers. nil means real time
+	WakeLimiter          *WakeLimiter      // Wake limiter of the proxy to record its rejected count to the state file
 }
 
 func (o Option) ToProcessOption() ProcessOption {
 	return ProcessOption{
-		PidPath:        o.PidPath,
-		HealthCheckUrl: o.HealthCheckUrl,
-		WakeTimeout:    o.WakeTimeout,
-		DrainTimeout:   o.DrainTimeout,
-		Cmd:            o.Cmd,
-		Args:           o.Args,
-		Logger:         o.Logger,
-		CriuPath:       o.CriuPath,
-		CriuDumpPath:   o.CriuDumpPath,
+		PidPath:              o.PidPath,
+		HealthCheckUrl:       o.HealthCheckUrl,
+		WakeTimeout:          o.WakeTimeout,
+		DrainTimeout:         o.DrainTimeout,
+		DrainPolicy:          o.DrainPolicy,
+		DrainTimeoutMin:      o.DrainTimeoutMin,
+		DrainTimeoutMax:      o.DrainTimeoutMax,
+		Cmd:                  o.Cmd,
+		Args:                 o.Args,
+		Logger:               o.Logger,
+		CriuPath:             o.CriuPath,
+		CriuDumpPath:         o.CriuDumpPath,
+		AwakeSchedules:       o.AwakeSchedules,
+		PreWake:              o.PreWake,
+		SleepOutside:         o.SleepOutside,
+		MaxAwake:             o.MaxAwake,
+		MaxRequests:          o.MaxRequests,
+		StatePath:            o.StatePath,
+		MemoryLimit:          o.MemoryLimit,
+		MemoryPressure:       o.MemoryPressure,
+		MaxQueued:            o.MaxQueued,
+		MaxQueueWait:         o.MaxQueueWait,
+		CancelAbandonedWake:  o.CancelAbandonedWake,
+		HealthCheckTransport: o.HealthCheckTransport,
+	}
+}
+
+type ProxyOption struct {
+	HealthCheckUrl        *url.URL
+	LivenessPath          string
+	ReadinessPath         string
+	WaitingPage           *template.Template
+	RetryAfter            time.Duration
+	ErrorHandler          ErrorHandler
+	ExemptRules           []ExemptRule
+	Cache                 *ResponseCache
+	CacheScope            string // Prefix of cache keys to separate upstreams sharing Cache. NewHandler uses the destination if empty
+	StaticDir             string
+	WakeLimiter           *WakeLimiter
+	Logger                *slog.Logger
+	Upstream              UpstreamOption
+	HealthCheckTransport  http.RoundTripper
+	GRPC                  bool          // Accept h2c on the listener and flush streaming responses immediately
+	ProxyProtocolUpstream int           // Version of PROXY protocol header sent to tcp upstreams by ServeTCPProxy. 0 means none
+	UDPFlowTimeout        time.Duration // Keep UDP flow of each client without datagrams for this duration in ServeUDPProxy
+	UDPMaxFlows           int           // Max count of UDP flows in ServeUDPProxy. 0 means DefaultUDPMaxFlows
+	Clock                 clock.Clock   // Clock for timers and wake limit. nil means real time
+}
+
+func (o Option) ToProxyOption() ProxyOption {
+	var wakeLimiter *WakeLimiter
+	if o.WakeLimitBurst > 0 || len(o.WakeAllow) > 0 || len(o.WakeDeny) > 0 {
+		wakeLimiter = NewWakeLimiter(o.WakeLimitBurst, o.WakeLimitPer, o.WakeAllow, o.WakeDeny)
+	}
+	return ProxyOption{
+		HealthCheckUrl:        o.HealthCheckUrl,
+		LivenessPath:          o.LivenessPath,
+		ReadinessPath:         o.ReadinessPath,
+		WaitingPage:           o.WaitingPage,
+		RetryAfter:            o.RetryAfter,
+		ErrorHandler:          NewErrorHandler(o.ErrorPage, o.ErrorJson, o.Logger),
+		ExemptRules:           o.ExemptRules,
+		StaticDir:             o.StaticDir,
+		WakeLimiter:           wakeLimiter,
+		Logger:                o.Logger,
+		Upstream:              o.Upstream,
+		ProxyProtocolUpstream: o.ProxyProtocolUpstream,
+		HealthCheckTransport:  o.HealthCheckTransport,
+		UDPFlowTimeout:        o.UDPFlowTimeout,
+		UDPMaxFlows:           o.UDPMaxFlows,
+	}
+}
+
+func (o ProxyOption) errorHandler() ErrorHandler {
+	if o.ErrorHandler != nil {
+		return o.ErrorHandler
 	}
+	return NewErrorHandler(nil, nil, o.Logger)
 }
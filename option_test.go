@@ -0,0 +1,44 @@
+package saving
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestDrainTimeoutBounds(t *testing.T) {
+	t.Setenv("SAVING_PORT_MAPS", "8080:8000")
+	t.Setenv("SAVING_DRAIN_TIMEOUT_MIN", "5m")
+	t.Setenv("SAVING_DRAIN_TIMEOUT_MAX", "1m")
+
+	// bounds are not used by fixed policy
+	_, err := InitOption([]string{"server"})
+	assert.NoError(t, err)
+
+	t.Setenv("SAVING_DRAIN_POLICY", "adaptive")
+	_, err = InitOption([]string{"server"})
+	assert.IsError(t, err, ErrParseOption)
+
+	t.Setenv("SAVING_DRAIN_TIMEOUT_MAX", "10m")
+	opt, err := InitOption([]string{"server"})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, opt.DrainTimeoutMin)
+	assert.Equal(t, 10*time.Minute, opt.DrainTimeoutMax)
+}
+
+func TestRecycleWithCriu(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("criu is available only on linux")
+	}
+	t.Setenv("SAVING_PORT_MAPS", "8080:8000")
+	t.Setenv("SAVING_CRIU_PATH", "sh")
+	_, err := InitOption([]string{"server"})
+	assert.NoError(t, err)
+
+	// restore from the dump doesn't refresh the process
+	t.Setenv("SAVING_MAX_REQUESTS", "100")
+	_, err = InitOption([]string{"server"})
+	assert.IsError(t, err, ErrParseOption)
+}
@@ -0,0 +1,81 @@
+package saving
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// readinessCheckTimeout is timeout of the health check request of the built-in readiness endpoint.
+const readinessCheckTimeout = 5 * time.Second
+
+// CheckProcessLiveness reports whether the saving process itself is running.
+//
+// It never touches the server process, so a slow or sleeping server process
+// doesn't make orchestrators restart the container.
+func CheckProcessLiveness(pidPath string) bool {
+	pid, _, err := readPid(pidPath)
+	if err != nil {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// CheckProcessReadiness reports whether saving can serve requests.
+//
+// A sleeping server process is treated as ready because saving wakes it on demand.
+// An awake server process is ready only when its health check passes. The health check uses
+// transport like Option.HealthCheckTransport, and nil means http.DefaultTransport.
+func CheckProcessReadiness(pidPath string, transport http.RoundTripper) bool {
+	if !CheckProcessLiveness(pidPath) {
+		return false
+	}
+	_, healthCheckUrl, err := readPid(pidPath)
+	if err != nil {
+		return false
+	}
+	if healthCheckUrl == nil { // only saving process is working
+		return true
+	}
+	return checkHealthContext(context.Background(), healthCheckClient(transport), readinessCheckTimeout, healthCheckUrl)
+}
+
+// withProbes answers built-in liveness/readiness endpoints without waking the server process.
+func withProbes(next http.Handler, process ProcessController, opt ProxyOption) http.Handler {
+	if opt.LivenessPath == "" && opt.ReadinessPath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case opt.LivenessPath != "" && r.URL.Path == opt.LivenessPath:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "ok")
+		case opt.ReadinessPath != "" && r.URL.Path == opt.ReadinessPath:
+			status := processStatus(process)
+			ready := true
+			switch status {
+			case Failed:
+				ready = false
+			case Waked:
+				ready = opt.HealthCheckUrl == nil || checkHealthContext(r.Context(), healthCheckClient(opt.HealthCheckTransport), readinessCheckTimeout, opt.HealthCheckUrl)
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if ready {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, "ready: %#v\n", status)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "not ready: %#v\n", status)
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package saving
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+type stubProcess struct {
+	status Status
+	err    error
+	execs  atomic.Int32
+}
+
+func (s *stubProcess) Exec(callback func()) error {
+	return s.ExecContext(context.Background(), callback)
+}
+
+func (s *stubProcess) ExecContext(ctx context.Context, callback func()) error {
+	s.execs.Add(1)
+	if s.err != nil {
+		return s.err
+	}
+	callback()
+	return nil
+}
+
+func (s *stubProcess) IsWaking() bool {
+	return s.status == Waked
+}
+
+func (s *stubProcess) Status() Status {
+	return s.status
+}
+
+func (s *stubProcess) Pid() int {
+	return 0
+}
+
+func TestLiveness(t *testing.T) {
+	pidPath := filepath.Join(t.TempDir(), "pid")
+	assert.False(t, CheckProcessLiveness(pidPath))
+	assert.NoError(t, writePid(pidPath, nil))
+	assert.True(t, CheckProcessLiveness(pidPath))
+	assert.True(t, CheckProcessReadiness(pidPath, nil))
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	opt := ProxyOption{LivenessPath: "/livez", ReadinessPath: "/readyz"}
+
+	testcases := []struct {
+		name   string
+		status Status
+		path   string
+		want   int
+	}{
+		{"liveness while sleeping", Drained, "/livez", http.StatusOK},
+		{"liveness after failure", Failed, "/livez", http.StatusOK},
+		{"readiness while sleeping", Drained, "/readyz", http.StatusOK},
+		{"readiness after failure", Failed, "/readyz", http.StatusServiceUnavailable},
+		{"other path", Drained, "/hello", http.StatusTeapot},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			process := &stubProcess{status: tc.status}
+			handler := withProbes(next, process, opt)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+}
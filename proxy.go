@@ -3,61 +3,284 @@ package saving
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"time"
 )
 
 // StartProxy is a main function of this package.
+//
+// It binds all ports and loads the cache before it starts the server process controller, and returns
+// the error if any port can't be bound or the cache can't be loaded. Then it serves until ctx is done.
 func StartProxy(ctx context.Context, opt Option) error {
+	var tlsConfig *tls.Config
+	if slices.ContainsFunc(opt.PortMaps, func(p PortMap) bool { return p.TLS }) {
+		c, err := NewTLSConfig(opt.TLS, opt.Logger)
+		if err != nil {
+			return err
+		}
+		tlsConfig = c
+	}
+	// each port has either a listener or a UDP socket
+	listeners := make([]net.Listener, len(opt.PortMaps))
+	packetConns := make([]net.PacketConn, len(opt.PortMaps))
+	closeListeners := func() {
+		for i := range opt.PortMaps {
+			if listeners[i] != nil {
+				listeners[i].Close()
+			}
+			if packetConns[i] != nil {
+				packetConns[i].Close()
+			}
+		}
+	}
+	for i, p := range opt.PortMaps {
+		if p.Destination.Scheme == "udp" {
+			c := p.PacketConn
+			if c == nil {
+				var err error
+				c, err = net.ListenPacket("udp", p.FromPort)
+				if err != nil {
+					closeListeners()
+					return fmt.Errorf("listen %s: %w", p.FromPort, err)
+				}
+			}
+			packetConns[i] = c
+			continue
+		}
+		l := p.Listener
+		if l == nil {
+			var err error
+			l, err = listen(p.FromPort, opt.UnixSocketMode)
+			if err != nil {
+				closeListeners()
+				return fmt.Errorf("listen %s: %w", p.FromPort, err)
+			}
+		}
+		if p.ProxyProtocol {
+			l = NewProxyProtocolListener(l, opt.ProxyProtocolTrusted)
+		}
+		if p.TLS {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners[i] = l
+	}
+
+	// the fallible steps run before the process controller starts the server process
+	proxyOpt := opt.ToProxyOption()
+	if opt.Cache {
+		cache, err := NewResponseCache(CacheOption{
+			Path:        opt.CachePath,
+			MaxStale:    opt.CacheMaxStale,
+			MaxSize:     opt.CacheSize,
+			MaxBodySize: opt.CacheMaxBodySize,
+		})
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		proxyOpt.Cache = cache
+	}
+
+	processOpt := opt.ToProcessOption()
+	processOpt.WakeLimiter = proxyOpt.WakeLimiter
 	var process ProcessController
 	var err error
 	if opt.CriuPath != "" {
-		process, err = NewCriuProcessController(ctx, opt.ToProcessOption())
+		process, err = NewCriuProcessController(ctx, processOpt)
 	} else {
-		process, err = NewExecKillProcessController(ctx, opt.ToProcessOption())
+		process, err = NewExecKillProcessController(ctx, processOpt)
 	}
 	if err != nil {
+		closeListeners()
 		return err
 	}
 
-	for _, p := range opt.PortMaps {
-		NewSingleProxyServer(ctx, process, p.FromPort, p.Destination)
+	if proxyOpt.Cache != nil {
+		startCacheSaver(ctx, proxyOpt.Cache, CacheSaveInterval, nil, opt.Logger)
+	}
+
+	servers := make([]*ProxyServer, len(opt.PortMaps))
+	for i, l := range listeners {
+		portOpt := proxyOpt
+		portOpt.GRPC = opt.PortMaps[i].GRPC
+		if dest := opt.PortMaps[i].Destination; dest.Scheme == "udp" {
+			servers[i] = ServeUDPProxy(ctx, process, packetConns[i], dest, portOpt)
+		} else if dest.Scheme == "tcp" {
+			servers[i] = ServeTCPProxy(ctx, process, l, dest, portOpt)
+		} else {
+			servers[i] = ServeProxy(ctx, process, l, dest, portOpt)
+		}
+	}
+	for _, s := range servers {
+		<-s.Done()
 	}
-	<-ctx.Done()
 	os.Remove(opt.PidPath)
+	if proxyOpt.Cache != nil {
+		if err := proxyOpt.Cache.Save(); err != nil {
+			opt.Logger.Warn("cache save error", "detail", err.Error())
+		}
+	}
 	return nil
 }
 
-func NewSingleProxyServer(ctx context.Context, process ProcessController, listeningPort string, dest *url.URL) *http.Server {
-	server := &http.Server{
-		Addr: listeningPort,
-		Handler: &httputil.ReverseProxy{
-			Rewrite: func(r *httputil.ProxyRequest) {
-				process.Exec(func() {
-					r.SetURL(dest)
-					r.SetXForwarded()
-				})
-			},
+// ProxyServer is a server started by ServeProxy, ServeTCPProxy or ServeUDPProxy.
+type ProxyServer struct {
+	Server     *http.Server   // nil for ServeTCPProxy and ServeUDPProxy
+	Listener   net.Listener   // nil for ServeUDPProxy
+	PacketConn net.PacketConn // only for ServeUDPProxy
+	done       chan struct{}
+}
+
+// Done is closed when the server is shut down.
+func (s *ProxyServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// NewSingleProxyServer binds listeningPort and serves NewHandler on it until ctx is done.
+// listeningPort can be unix domain socket like "unix:/run/app.sock". It returns the bind error.
+func NewSingleProxyServer(ctx context.Context, process ProcessController, listeningPort string, dest *url.URL, opt ProxyOption) (*ProxyServer, error) {
+	l, err := listen(listeningPort, 0)
+	if err != nil {
+		return nil, err
+	}
+	return ServeProxy(ctx, process, l, dest, opt), nil
+}
+
+// ServeProxy serves NewHandler on the pre-opened listener until ctx is done.
+//
+// If opt.GRPC is set, it also accepts HTTP/2 without TLS (h2c) for gRPC clients.
+//
+// Serve and shutdown errors are logged.
+func ServeProxy(ctx context.Context, process ProcessController, listener net.Listener, dest *url.URL, opt ProxyOption) *ProxyServer {
+	logger := opt.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	result := &ProxyServer{
+		Server: &http.Server{
+			Handler: NewHandler(process, dest, opt),
 		},
+		Listener: listener,
+		done:     make(chan struct{}),
+	}
+	if opt.GRPC {
+		result.Server.Protocols = new(http.Protocols)
+		result.Server.Protocols.SetHTTP1(true)
+		result.Server.Protocols.SetHTTP2(true)
+		result.Server.Protocols.SetUnencryptedHTTP2(true)
 	}
+	served := make(chan struct{})
 	go func() {
-		server.ListenAndServe()
+		defer close(served)
+		if err := result.Server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("serve error", "addr", listener.Addr().String(), "detail", err.Error())
+		}
 	}()
 	go func() {
-		<-ctx.Done()
+		defer close(result.done)
+		select {
+		case <-ctx.Done():
+		case <-served:
+			return
+		}
 		ctx2, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := server.Shutdown(ctx2); err != nil {
-			panic(err)
+		if err := result.Server.Shutdown(ctx2); err != nil {
+			logger.Warn("shutdown error", "addr", listener.Addr().String(), "detail", err.Error())
 		}
 	}()
-	return server
+	return result
+}
+
+// NewHandler returns reverse proxy to dest that wakes the server process on demand.
+//
+// It is the handler StartProxy serves on each port. Use it to mount saving in your own server.
+// dest can be any URL that ParseUpstream accepts, and opt.Upstream is used for https dest.
+func NewHandler(process ProcessController, dest *url.URL, opt ProxyOption) http.Handler {
+	if opt.CacheScope == "" {
+		opt.CacheScope = dest.String()
+	}
+	errorHandler := opt.errorHandler()
+	transport, target := NewUpstreamTransport(dest, opt.Upstream)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			errorHandler(w, r, UpstreamRefused, err)
+		},
+	}
+	if !opt.GRPC {
+		return Middleware(process, opt)(proxy)
+	}
+	proxy.FlushInterval = -1
+	return Middleware(process, opt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) {
+			w = flushHeaderWriter{w}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+}
+
+// Middleware returns middleware that runs next inside process.ExecContext (or Exec if process doesn't
+// implement ContextExecutor), so the server process is woken before next is called and kept awake until next returns.
+//
+// next is usually a reverse proxy to the server process. Built-in probes, wake-exempt rules,
+// static files, cache, wake limit and waiting page in opt are applied before waking.
+func Middleware(process ProcessController, opt ProxyOption) func(next http.Handler) http.Handler {
+	errorHandler := opt.errorHandler()
+	return func(next http.Handler) http.Handler {
+		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			failed := processStatus(process) == Failed
+			// the request is served inside Exec to keep the server process awake until the response is finished
+			err := execContext(r.Context(), process, func() {
+				next.ServeHTTP(w, r)
+			})
+			if err != nil && r.Context().Err() != nil {
+				return // the client is gone
+			}
+			if err != nil {
+				kind := WakeFailed
+				switch {
+				case errors.Is(err, ErrQueueFull), errors.Is(err, ErrQueueTimeout):
+					kind = QueueFull
+					retryAfter := opt.RetryAfter
+					if retryAfter == 0 {
+						retryAfter = DefaultRefreshInterval
+					}
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				case !failed && errors.Is(err, ErrHealthCheckFailed):
+					kind = WakeTimeout
+				}
+				errorHandler(w, r, kind, err)
+			}
+		})
+		handler = withWaiting(handler, process, opt)
+		handler = withWakeLimit(handler, process, opt)
+		handler = withCache(handler, process, opt)
+		handler = withStaticDir(handler, opt)
+		handler = withExemptRules(handler, opt)
+		handler = withProbes(handler, process, opt)
+		return handler
+	}
 }
 
-func CheckProcessHealth(PidPath string) bool {
+// CheckProcessHealth reports whether the pid file exists and the server process is healthy if it is awake.
+// The health check uses transport like Option.HealthCheckTransport, and nil means http.DefaultTransport.
+func CheckProcessHealth(PidPath string, transport http.RoundTripper) bool {
 	content, err := os.ReadFile(PidPath)
 	if os.IsNotExist(err) {
 		return false
@@ -67,5 +290,5 @@ func CheckProcessHealth(PidPath string) bool {
 		return true
 	}
 	u, _ := url.Parse(string(chunks[1]))
-	return CheckHealth(u)
+	return checkHealthContext(context.Background(), healthCheckClient(transport), readinessCheckTimeout, u)
 }
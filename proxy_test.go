@@ -0,0 +1,86 @@
+package saving
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestStartProxyBindError(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer occupied.Close()
+
+	pidPath := filepath.Join(t.TempDir(), "pid")
+	dest, _ := url.Parse("http://localhost:1")
+	err = StartProxy(context.Background(), Option{
+		PortMaps: []PortMap{{FromPort: occupied.Addr().String(), Destination: dest}},
+		PidPath:  pidPath,
+		Cmd:      "false",
+	})
+	assert.Error(t, err)
+	// the server process controller is not started
+	_, err = os.Stat(pidPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStartProxyCacheError(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache")
+	assert.NoError(t, os.WriteFile(cachePath, []byte("broken"), 0o600))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	pidPath := filepath.Join(dir, "pid")
+	dest, _ := url.Parse("http://localhost:1")
+	err = StartProxy(context.Background(), Option{
+		PortMaps:  []PortMap{{FromPort: listener.Addr().String(), Listener: listener, Destination: dest}},
+		PidPath:   pidPath,
+		Cmd:       "false",
+		Cache:     true,
+		CachePath: cachePath,
+	})
+	assert.Error(t, err)
+	// the server process controller is not started, and the listener is closed
+	_, err = os.Stat(pidPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = listener.Accept()
+	assert.Error(t, err)
+}
+
+func TestServeProxyWithListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	dest, _ := url.Parse(backend.URL)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	server := ServeProxy(ctx, &stubProcess{status: Waked}, listener, dest, ProxyOption{})
+
+	res, err := http.Get("http://" + listener.Addr().String() + "/")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "backend", string(body))
+
+	cancel()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server is not shut down")
+	}
+	_, err = http.Get("http://" + listener.Addr().String() + "/")
+	assert.Error(t, err)
+}
@@ -0,0 +1,264 @@
+package saving
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrProxyProtocol = errors.New("proxy protocol error")
+
+// proxyHeaderTimeout is max duration to wait for PROXY protocol header after connection.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyProtocolV2Signature is the first 12 bytes of PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// NewProxyProtocolListener returns listener that reads PROXY protocol v1 or v2 header
+// sent by load balancers like HAProxy or AWS NLB, and reports the client address in it as RemoteAddr.
+//
+// Connections from trusted sources must start with the header. Connections from other sources
+// are passed as they are. Empty trusted means all sources are trusted.
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: l, trusted: trusted}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 {
+		ip := addrIP(conn.RemoteAddr())
+		if ip == nil || !containsIP(l.trusted, ip) {
+			return conn, nil
+		}
+	}
+	// the header is read lazily in the goroutine of the connection, so slow clients don't block Accept
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// proxyProtocolConn is a connection that starts with PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite closes writing side of the underlying TCP connection.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header. Addresses are nil for
+// UNKNOWN (v1) and LOCAL (v2) headers like health checks of load balancers.
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyProtocol, err)
+	}
+	switch {
+	case bytes.Equal(start, proxyProtocolV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return nil, nil, fmt.Errorf("%w: no header", ErrProxyProtocol)
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 { // max length of v1 header
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrProxyProtocol, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if !bytes.HasSuffix(line, []byte("\r\n")) || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("%w: invalid v1 header", ErrProxyProtocol)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, nil, fmt.Errorf("%w: invalid v1 header", ErrProxyProtocol)
+		}
+		src, err1 := parseAddrPort(fields[2], fields[4])
+		dst, err2 := parseAddrPort(fields[3], fields[5])
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid v1 header: %w", ErrProxyProtocol, err)
+		}
+		return net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst), nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown v1 protocol: '%s'", ErrProxyProtocol, fields[1])
+	}
+}
+
+func parseAddrPort(addr, port string) (netip.AddrPort, error) {
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(a, uint16(p)), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyProtocol, err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: unknown version: %d", ErrProxyProtocol, header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyProtocol, err)
+	}
+	if header[12]&0x0f == 0 { // LOCAL command
+		return nil, nil, nil
+	}
+	var size int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	default: // AF_UNSPEC and AF_UNIX
+		return nil, nil, nil
+	}
+	if len(body) < size*2+4 {
+		return nil, nil, fmt.Errorf("%w: short v2 address", ErrProxyProtocol)
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	dst, _ := netip.AddrFromSlice(body[size : size*2])
+	srcPort := binary.BigEndian.Uint16(body[size*2:])
+	dstPort := binary.BigEndian.Uint16(body[size*2+2:])
+	if header[13]&0x0f == 2 { // DGRAM
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)), net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort)), nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)), net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort)), nil
+}
+
+// writeProxyHeader writes PROXY protocol header of version 1 or 2 for the connection from src to dst.
+// The header is UNKNOWN (v1) or LOCAL (v2) if the addresses are not TCP addresses.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	var srcIP, dstIP netip.Addr
+	if srcOk && dstOk {
+		srcIP = srcAddr.AddrPort().Addr().Unmap()
+		dstIP = dstAddr.AddrPort().Addr().Unmap()
+		if srcIP.Is4() != dstIP.Is4() {
+			srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+		}
+	}
+	known := srcIP.IsValid() && dstIP.IsValid()
+
+	var header []byte
+	switch version {
+	case 1:
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		proto := "TCP4"
+		if !srcIP.Is4() {
+			proto = "TCP6"
+		}
+		header = fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+	case 2:
+		header = append(header, proxyProtocolV2Signature...)
+		if !known {
+			header = append(header, 0x20, 0x00, 0, 0) // LOCAL, AF_UNSPEC
+			break
+		}
+		family := byte(0x11) // AF_INET, STREAM
+		if !srcIP.Is4() {
+			family = 0x21 // AF_INET6, STREAM
+		}
+		addrs := slices.Concat(srcIP.AsSlice(), dstIP.AsSlice())
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcAddr.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstAddr.Port))
+		header = append(header, 0x21, family) // PROXY command
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+		header = append(header, addrs...)
+	default:
+		return fmt.Errorf("%w: unknown version: %d", ErrProxyProtocol, version)
+	}
+	_, err := w.Write(header)
+	return err
+}
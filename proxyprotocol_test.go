@@ -0,0 +1,199 @@
+package saving
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	testcases := []struct {
+		name    string
+		header  string
+		remote  string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", "203.0.113.7:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", "[2001:db8::7]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v2 local", string(proxyProtocolV2Signature) + "\x20\x00\x00\x00", "", false},
+		{"v2 tcp4", string(proxyProtocolV2Signature) + "\x21\x11\x00\x0c" + "\xcb\x00\x71\x07" + "\xc0\x00\x02\x01" + "\xdc\x04\x01\xbb", "203.0.113.7:56324", false},
+		{"no header", "GET / HTTP/1.1\r\n", "", true},
+		{"broken v1", "PROXY TCP4 203.0.113.7\r\n", "", true},
+		{"v1 without crlf", "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\n", "", true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.header + "payload"))
+			remote, _, err := readProxyHeader(r)
+			if tc.wantErr {
+				assert.IsError(t, err, ErrProxyProtocol)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.remote == "" {
+				assert.Zero(t, remote)
+			} else {
+				assert.Equal(t, tc.remote, remote.String())
+			}
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	for _, version := range []int{1, 2} {
+		var b strings.Builder
+		assert.NoError(t, writeProxyHeader(&b, version, src, dst))
+		remote, local, err := readProxyHeader(bufio.NewReader(strings.NewReader(b.String())))
+		assert.NoError(t, err)
+		// IPv4 address is sent as IPv4-mapped IPv6 address because the family of dst is IPv6
+		assert.Equal(t, "203.0.113.7:56324", remote.String())
+		assert.Equal(t, "[2001:db8::1]:443", local.String())
+	}
+	var b strings.Builder
+	assert.NoError(t, writeProxyHeader(&b, 1, &net.UnixAddr{Name: "/run/app.sock"}, &net.UnixAddr{}))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", b.String())
+}
+
+// sendWithProxyHeader connects to addr and sends PROXY protocol v1 header of client and data,
+// and returns the response until the connection is closed.
+func sendWithProxyHeader(t *testing.T, addr, client, data string, closeWrite bool) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	header := ""
+	if client != "" {
+		header = "PROXY TCP4 " + client + " 127.0.0.1 56324 80\r\n"
+	}
+	_, err = io.WriteString(conn, header+data)
+	assert.NoError(t, err)
+	if closeWrite {
+		conn.(*net.TCPConn).CloseWrite()
+	}
+	result, _ := io.ReadAll(conn)
+	return string(result)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "client="+r.Header.Get("X-Forwarded-For"))
+	})}
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go backend.Serve(backendListener)
+	defer backend.Close()
+	dest := &url.URL{Scheme: "http", Host: backendListener.Addr().String()}
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	testcases := []struct {
+		name    string
+		trusted string
+		client  string
+		want    string
+	}{
+		{"trusted", "127.0.0.0/8", "203.0.113.7", "client=203.0.113.7"},
+		{"any source is trusted", "", "203.0.113.7", "client=203.0.113.7"},
+		{"untrusted source", "10.0.0.0/8", "", "client=127.0.0.1"},
+		{"trusted source without header", "127.0.0.0/8", "", "400 Bad Request"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			trusted, err := ParseCIDRs(tc.trusted)
+			assert.NoError(t, err)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ServeProxy(ctx, &stubProcess{status: Waked}, NewProxyProtocolListener(listener, trusted), dest, ProxyOption{})
+
+			res := sendWithProxyHeader(t, listener.Addr().String(), tc.client, request, false)
+			assert.True(t, strings.HasSuffix(res, tc.want), "response: %s", res)
+		})
+	}
+}
+
+func TestTCPProxyWithProxyProtocol(t *testing.T) {
+	// upstream answers the client address in the header and the data
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				remote, _, err := readProxyHeader(r)
+				if err != nil {
+					io.WriteString(conn, err.Error())
+					return
+				}
+				data, _ := io.ReadAll(r)
+				io.WriteString(conn, remote.String()+" "+string(data))
+			}()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	process := &stubProcess{status: Waked}
+	server := ServeTCPProxy(ctx, process, NewProxyProtocolListener(listener, nil),
+		&url.URL{Scheme: "tcp", Host: upstream.Addr().String()}, ProxyOption{ProxyProtocolUpstream: 2})
+
+	res := sendWithProxyHeader(t, listener.Addr().String(), "203.0.113.7", "hello", true)
+	assert.Equal(t, "203.0.113.7:56324 hello", res)
+	assert.Equal(t, int32(1), process.execs.Load())
+
+	cancel()
+	<-server.Done()
+}
+
+func TestTCPProxyWakeLimit(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "hello")
+			conn.Close()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	process := &stubProcess{status: Drained}
+	deny, err := ParseCIDRs("203.0.113.0/24")
+	assert.NoError(t, err)
+	server := ServeTCPProxy(ctx, process, NewProxyProtocolListener(listener, nil),
+		&url.URL{Scheme: "tcp", Host: upstream.Addr().String()}, ProxyOption{WakeLimiter: NewWakeLimiter(0, 0, nil, deny)})
+
+	// the client address in the header is denied, though the load balancer is not
+	assert.Equal(t, "", sendWithProxyHeader(t, listener.Addr().String(), "203.0.113.7", "", true))
+	assert.Equal(t, int32(0), process.execs.Load())
+	assert.Equal(t, "hello", sendWithProxyHeader(t, listener.Addr().String(), "198.51.100.7", "", true))
+	assert.Equal(t, int32(1), process.execs.Load())
+
+	cancel()
+	<-server.Done()
+}
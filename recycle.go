@@ -0,0 +1,76 @@
+package saving
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// RecycleGrace is duration the server process keeps serving new requests after recycle is requested.
+// After that, new requests wait for the fresh process, so overlapping requests can't postpone recycle.
+var RecycleGrace = 30 * time.Second
+
+// recycler recycles the server process after maximum awake time or request count.
+//
+// It uses Drainable.SleepWithin, so the current process serves requests until no requests run
+// within RecycleGrace, and requests after that are served by the fresh process.
+type recycler struct {
+	drainable   *Drainable
+	maxAwake    time.Duration
+	maxRequests uint64
+	logger      *slog.Logger
+	clock       clock.Clock
+	lock        sync.Mutex
+	timer       clock.Timer
+}
+
+func newRecycler(drainable *Drainable, maxAwake time.Duration, maxRequests uint64, clk clock.Clock, logger *slog.Logger) *recycler {
+	return &recycler{
+		drainable:   drainable,
+		maxAwake:    maxAwake,
+		maxRequests: maxRequests,
+		clock:       clock.OrReal(clk),
+		logger:      logger,
+	}
+}
+
+// started should be called when the server process starts.
+func (r *recycler) started() {
+	if r.maxAwake == 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = r.clock.AfterFunc(r.maxAwake, func() {
+		r.recycle("max awake time", slog.Duration("max_awake", r.maxAwake))
+	})
+}
+
+// stopped should be called when the server process stops.
+func (r *recycler) stopped() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// accessed should be called with request count of the current server process.
+func (r *recycler) accessed(count uint64) {
+	if r.maxRequests > 0 && count >= r.maxRequests && r.drainable.Status() == Waked {
+		r.recycle("max requests", slog.Uint64("max_requests", r.maxRequests))
+	}
+}
+
+func (r *recycler) recycle(reason string, attr slog.Attr) {
+	// requests until the drain call this again, but only the first one starts draining
+	if r.drainable.SleepWithin(RecycleGrace) {
+		r.logger.Info("process recycle", slog.String("reason", reason), attr, slog.Duration("grace", RecycleGrace))
+	}
+}
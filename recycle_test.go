@@ -0,0 +1,146 @@
+package saving
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+func wait(wait time.Duration) func() error {
+	return func() error {
+		time.Sleep(wait)
+		return nil
+	}
+}
+
+func TestRecycleByRequests(t *testing.T) {
+	var boots atomic.Int32
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(func() error {
+		boots.Add(1)
+		return nil
+	}, wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	r := newRecycler(drainable, 0, 3, clk, slog.Default())
+
+	for i := range uint64(2) {
+		assert.NoError(t, drainable.Exec(func() { r.accessed(i + 1) }))
+	}
+	assert.Equal(t, Waked, drainable.Status())
+	// the request that reaches the limit is served, then the process drains without drain timeout
+	assert.NoError(t, drainable.Exec(func() { r.accessed(3) }))
+	assert.Equal(t, Waked, drainable.Status())
+	clk.Advance(0)
+	assert.Equal(t, Drained, drainable.Status())
+
+	assert.NoError(t, drainable.Exec(func() {}))
+	assert.Equal(t, int32(2), boots.Load())
+}
+
+// waitTimers waits until clk has n timers.
+func waitTimers(t *testing.T, clk *clocktest.Fake, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clk.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timers should be %d, but %d", n, clk.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecycleWhileHeld(t *testing.T) {
+	var boots atomic.Int32
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(func() error {
+		boots.Add(1)
+		return nil
+	}, wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	r := newRecycler(drainable, time.Minute, 0, clk, slog.Default())
+	release, err := drainable.Hold()
+	assert.NoError(t, err)
+	defer release()
+	r.started()
+	clk.Advance(time.Minute)
+
+	// requests are served by the current process during grace
+	for range 3 {
+		called := false
+		assert.NoError(t, drainable.Exec(func() { called = true }))
+		assert.True(t, called)
+	}
+	assert.Equal(t, int32(1), boots.Load())
+
+	// then the hold moves to the fresh process
+	clk.Advance(RecycleGrace)
+	waitTimers(t, clk, 1)
+	clk.Advance(0)
+	waitTimers(t, clk, 0)
+	assert.Equal(t, Waked, drainable.Status())
+	assert.Equal(t, int32(2), boots.Load())
+}
+
+func TestRecycleOverlappingRequests(t *testing.T) {
+	var boots atomic.Int32
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(func() error {
+		boots.Add(1)
+		return nil
+	}, wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	r := newRecycler(drainable, 0, 2, clk, slog.Default())
+
+	// requests always overlap: a request is running whenever the next one comes
+	finish := make(chan struct{})
+	finished := make(chan error)
+	started := make(chan struct{})
+	go func() {
+		finished <- drainable.Exec(func() {
+			r.accessed(1)
+			close(started)
+			<-finish
+		})
+	}()
+	<-started
+	assert.NoError(t, drainable.Exec(func() { r.accessed(2) }))
+	assert.NoError(t, drainable.Exec(func() { r.accessed(3) }))
+	assert.Equal(t, int32(1), boots.Load())
+
+	clk.Advance(RecycleGrace)
+	result := make(chan error)
+	go func() {
+		result <- drainable.Exec(func() {})
+	}()
+	close(finish)
+	assert.NoError(t, <-finished)
+	waitTimers(t, clk, 1)
+	clk.Advance(0)
+	assert.NoError(t, <-result)
+	assert.Equal(t, int32(2), boots.Load())
+}
+
+func TestRecycleByAwakeTime(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	drainable := NewDrainable(wait(0), wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	r := newRecycler(drainable, 100*time.Millisecond, 0, clk, slog.Default())
+	assert.NoError(t, drainable.Exec(func() {}))
+	r.started()
+	clk.Advance(50 * time.Millisecond)
+	assert.Equal(t, Waked, drainable.Status())
+	clk.Advance(50 * time.Millisecond)
+	assert.Equal(t, Drained, drainable.Status())
+
+	// timer is cancelled by stop
+	assert.NoError(t, drainable.Exec(func() {}))
+	r.started()
+	r.stopped()
+	clk.Advance(time.Second)
+	assert.Equal(t, Waked, drainable.Status())
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package saving
+
+import "os"
+
+func peakRSS(state *os.ProcessState) uint64 {
+	return 0
+}
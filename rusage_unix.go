@@ -0,0 +1,20 @@
+//go:build unix
+
+package saving
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func peakRSS(state *os.ProcessState) uint64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" { // bytes on macOS, kilobytes on others
+		return uint64(rusage.Maxrss)
+	}
+	return uint64(rusage.Maxrss) * 1024
+}
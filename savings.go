@@ -0,0 +1,126 @@
+package saving
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Savings is cumulative resource usage of the server process and estimated savings.
+type Savings struct {
+	Cycles                 uint64  `json:"cycles"`                    // Count of sleep cycles
+	AwakeSeconds           float64 `json:"awake_seconds"`             // Total time the server process was awake
+	AsleepSeconds          float64 `json:"asleep_seconds"`            // Total time the server process was sleeping
+	CPUSeconds             float64 `json:"cpu_seconds"`               // Total CPU time of the server process
+	PeakRSS                uint64  `json:"peak_rss"`                  // Maximum RSS of the server process in bytes
+	SavedMemoryByteSeconds float64 `json:"saved_memory_byte_seconds"` // Peak RSS of the previous cycle multiplied by the asleep time
+}
+
+// cycleUsage is resource usage of the server process during one awake period.
+type cycleUsage struct {
+	PeakRSS uint64
+	CPUTime time.Duration
+}
+
+// savingsTracker measures each sleep cycle and accumulates Savings in State.
+type savingsTracker struct {
+	state       *stateRecorder
+	logger      *slog.Logger
+	lock        sync.Mutex
+	awakeAt     time.Time
+	asleepAt    time.Time
+	lastPeakRSS uint64
+}
+
+// newSavingsTracker creates tracker. The server process is asleep since now.
+func newSavingsTracker(state *stateRecorder, now time.Time, logger *slog.Logger) *savingsTracker {
+	return &savingsTracker{
+		state:    state,
+		logger:   logger,
+		asleepAt: now,
+	}
+}
+
+// woke should be called when the server process becomes ready.
+func (t *savingsTracker) woke(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	asleep := now.Sub(t.asleepAt)
+	t.awakeAt = now
+	t.state.update(func(s *State) {
+		s.Savings.AsleepSeconds += asleep.Seconds()
+		s.Savings.SavedMemoryByteSeconds += float64(t.lastPeakRSS) * asleep.Seconds()
+	})
+}
+
+// slept should be called when the server process stops.
+func (t *savingsTracker) slept(now time.Time, usage cycleUsage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.awakeAt.IsZero() {
+		return
+	}
+	awake := now.Sub(t.awakeAt)
+	t.awakeAt = time.Time{}
+	t.asleepAt = now
+	t.lastPeakRSS = usage.PeakRSS
+	var total Savings
+	t.state.update(func(s *State) {
+		s.Savings.Cycles++
+		s.Savings.AwakeSeconds += awake.Seconds()
+		s.Savings.CPUSeconds += usage.CPUTime.Seconds()
+		s.Savings.PeakRSS = max(s.Savings.PeakRSS, usage.PeakRSS)
+		total = s.Savings
+	})
+	t.logger.Info("sleep cycle",
+		slog.Duration("awake", awake),
+		slog.Uint64("peak_rss", usage.PeakRSS),
+		slog.Duration("cpu_time", usage.CPUTime),
+		slog.Uint64("total_cycles", total.Cycles),
+		slog.Float64("total_saved_memory_byte_seconds", total.SavedMemoryByteSeconds))
+}
+
+// usageFromProcessState reads resource usage of exited process.
+func usageFromProcessState(state *os.ProcessState) cycleUsage {
+	if state == nil {
+		return cycleUsage{}
+	}
+	return cycleUsage{
+		PeakRSS: peakRSS(state),
+		CPUTime: state.UserTime() + state.SystemTime(),
+	}
+}
+
+// userHZ is clock ticks per second of /proc/<pid>/stat. It is 100 on most Linux systems.
+const userHZ = 100
+
+// usageFromProc reads resource usage of running process from procfs.
+func usageFromProc(pid int) cycleUsage {
+	var result cycleUsage
+	if hwm, err := readProcStatus(pid, "VmHWM"); err == nil {
+		result.PeakRSS = hwm
+	}
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return result
+	}
+	// command name can contain spaces, so fields are counted after ')'
+	_, rest, found := strings.Cut(string(content), ") ")
+	if !found {
+		return result
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 13 {
+		return result
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 == nil && err2 == nil {
+		result.CPUTime = time.Duration(utime+stime) * time.Second / userHZ
+	}
+	return result
+}
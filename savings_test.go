@@ -0,0 +1,52 @@
+package saving
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestSavingsTracker(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	start := time.Now()
+	tracker := newSavingsTracker(newStateRecorder(statePath), start.Add(-5*time.Second), slog.New(slog.DiscardHandler))
+
+	tracker.woke(start)
+	tracker.slept(start.Add(10*time.Second), cycleUsage{PeakRSS: 100, CPUTime: time.Second})
+	tracker.woke(start.Add(30 * time.Second))
+	tracker.slept(start.Add(35*time.Second), cycleUsage{PeakRSS: 50, CPUTime: 2 * time.Second})
+
+	state, err := ReadState(statePath)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), state.Savings.Cycles)
+	assert.Equal(t, 15.0, state.Savings.AwakeSeconds)
+	assert.Equal(t, 3.0, state.Savings.CPUSeconds)
+	assert.Equal(t, uint64(100), state.Savings.PeakRSS)
+	assert.Equal(t, 25.0, state.Savings.AsleepSeconds)
+	// 100 bytes x 20 seconds asleep after the first cycle
+	assert.Equal(t, 2000.0, state.Savings.SavedMemoryByteSeconds)
+}
+
+func TestUsageFromProcessState(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("rusage units are checked on Linux")
+	}
+	cmd := exec.Command("sh", "-c", "exit 0")
+	assert.NoError(t, cmd.Run())
+	usage := usageFromProcessState(cmd.ProcessState)
+	assert.True(t, usage.PeakRSS > 0)
+}
+
+func TestUsageFromProc(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("procfs is not available")
+	}
+	usage := usageFromProc(os.Getpid())
+	assert.True(t, usage.PeakRSS > 0)
+}
@@ -0,0 +1,165 @@
+package savingtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// BackendOptions configures Backend.
+type BackendOptions struct {
+	Addr         string        // Listen address. Default is a free port of 127.0.0.1
+	StartupDelay time.Duration // Delay before Start listens
+	HealthStatus int           // Status code of /health. Default is 200
+	Latency      time.Duration // Delay of each response except /health
+	Clock        clock.Clock   // Clock of the delays. nil means Clock of FakeOptions that starts it, or real time
+}
+
+// Backend is an HTTP server that behaves like the server process under saving.
+//
+// It answers /health with the health status, and other paths with "hello from <path>".
+// It also accepts HTTP/2 without TLS (h2c), and serves GRPCUnaryMethod and GRPCStreamMethod to gRPC requests.
+// It can be started and stopped repeatedly on the same address.
+type Backend struct {
+	addr         string
+	startupDelay time.Duration
+	clock        clock.Clock
+	healthStatus atomic.Int64
+	latency      atomic.Int64
+	requests     atomic.Int64
+	lock         sync.Mutex
+	server       *http.Server
+}
+
+// NewBackend creates Backend. It doesn't listen until Start is called.
+func NewBackend(opt BackendOptions) (*Backend, error) {
+	if opt.Addr == "" {
+		// reserve a free port, and listen on it again in Start
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		opt.Addr = l.Addr().String()
+		l.Close()
+	}
+	if opt.HealthStatus == 0 {
+		opt.HealthStatus = http.StatusOK
+	}
+	result := &Backend{
+		addr:         opt.Addr,
+		startupDelay: opt.StartupDelay,
+		clock:        opt.Clock,
+	}
+	result.healthStatus.Store(int64(opt.HealthStatus))
+	result.latency.Store(int64(opt.Latency))
+	return result, nil
+}
+
+// URL returns base URL of the backend.
+func (b *Backend) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: b.addr}
+}
+
+// HealthURL returns URL of the health check endpoint.
+func (b *Backend) HealthURL() *url.URL {
+	return b.URL().JoinPath("/health")
+}
+
+// SetHealthStatus changes status code of /health.
+func (b *Backend) SetHealthStatus(status int) {
+	b.healthStatus.Store(int64(status))
+}
+
+// SetLatency changes delay of responses.
+func (b *Backend) SetLatency(latency time.Duration) {
+	b.latency.Store(int64(latency))
+}
+
+// Requests returns count of requests except /health.
+func (b *Backend) Requests() int {
+	return int(b.requests.Load())
+}
+
+// Running reports whether the backend is listening.
+func (b *Backend) Running() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.server != nil
+}
+
+// wait waits d on the clock. It returns false if ctx is done.
+func (b *Backend) wait(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := clock.OrReal(b.clock).NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// Start listens after the startup delay.
+func (b *Backend) Start(ctx context.Context) error {
+	if !b.wait(ctx, b.startupDelay) {
+		return ctx.Err()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.server != nil {
+		return errors.New("backend is already running")
+	}
+	l, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return err
+	}
+	b.server = &http.Server{Handler: b, Protocols: new(http.Protocols)}
+	b.server.Protocols.SetHTTP1(true)
+	b.server.Protocols.SetUnencryptedHTTP2(true)
+	go b.server.Serve(l)
+	return nil
+}
+
+// Stop closes the listener and connections immediately like a killed process.
+func (b *Backend) Stop() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.server == nil {
+		return nil
+	}
+	err := b.server.Close()
+	b.server = nil
+	return err
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		status := int(b.healthStatus.Load())
+		w.WriteHeader(status)
+		fmt.Fprint(w, http.StatusText(status))
+		return
+	}
+	b.requests.Add(1)
+	if !b.wait(r.Context(), time.Duration(b.latency.Load())) {
+		return
+	}
+	if isGRPC(r) {
+		serveGRPC(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Backend-Requests", strconv.FormatInt(b.requests.Load(), 10))
+	fmt.Fprintf(w, "hello from %s", r.URL.Path)
+}
@@ -0,0 +1,82 @@
+package savingtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gRPC methods of Backend. Messages are raw bytes without protobuf encoding.
+const (
+	GRPCUnaryMethod  = "/saving.test.Echo/Unary"  // Returns the request message
+	GRPCStreamMethod = "/saving.test.Echo/Stream" // Returns each request message as soon as it arrives
+)
+
+// WriteGRPCMessage writes msg with the length-prefixed framing of gRPC.
+func WriteGRPCMessage(w io.Writer, msg []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(append(header, msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// ReadGRPCMessage reads a message written by WriteGRPCMessage. It returns io.EOF at the end of stream.
+func ReadGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed message is not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveGRPC serves the echo methods.
+func serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	status, message := "0", ""
+	switch r.URL.Path {
+	case GRPCUnaryMethod:
+		msg, err := ReadGRPCMessage(r.Body)
+		if err != nil {
+			status, message = "3", err.Error() // INVALID_ARGUMENT
+			break
+		}
+		WriteGRPCMessage(w, msg)
+	case GRPCStreamMethod:
+		// send headers before the first message for clients that wait for them
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		for {
+			msg, err := ReadGRPCMessage(r.Body)
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				status, message = "3", err.Error()
+				break
+			}
+			WriteGRPCMessage(w, msg)
+		}
+	default:
+		status, message = "12", "unknown method: "+r.URL.Path // UNIMPLEMENTED
+	}
+	w.Header().Set("Grpc-Status", status)
+	w.Header().Set("Grpc-Message", message)
+}
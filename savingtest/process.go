@@ -0,0 +1,161 @@
+// Package savingtest provides test doubles for programs that embed saving.
+package savingtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shibukawa/saving"
+	"github.com/shibukawa/saving/clock"
+	"github.com/shibukawa/saving/drainable"
+)
+
+// FakeOptions configures FakeProcess.
+type FakeOptions struct {
+	BootLatency  time.Duration // Duration of each boot on Clock
+	BootErrors   []error       // Results of boots in order. nil succeeds. Boots after the list succeed
+	CloseError   error         // Error of every close
+	DrainTimeout time.Duration // Default is 1m
+	Backend      *Backend      // Started by boots and stopped by closes if set
+	Clock        clock.Clock   // Clock of boot latency, drain timeout and delays of Backend without its own clock. nil means real time
+}
+
+// FakeProcess is a scriptable saving.ProcessController.
+//
+// It uses the same Drainable as the real controllers, so the status changes like the real one.
+type FakeProcess struct {
+	drainable *drainable.Drainable
+	opt       FakeOptions
+	clock     clock.Clock
+	lock      sync.Mutex
+	boots     int
+	pid       int
+	execs     atomic.Int64
+}
+
+var (
+	_ saving.ProcessController = (*FakeProcess)(nil)
+	_ saving.StatusReporter    = (*FakeProcess)(nil)
+	_ saving.ContextExecutor   = (*FakeProcess)(nil)
+)
+
+// NewFakeProcess creates FakeProcess.
+func NewFakeProcess(opt FakeOptions) *FakeProcess {
+	if opt.DrainTimeout == 0 {
+		opt.DrainTimeout = time.Minute
+	}
+	if opt.Backend != nil && opt.Backend.clock == nil {
+		opt.Backend.clock = opt.Clock
+	}
+	result := &FakeProcess{
+		opt:   opt,
+		clock: clock.OrReal(opt.Clock),
+	}
+	result.drainable = drainable.NewContext(result.boot, result.close, opt.DrainTimeout, func(s drainable.Status) {})
+	result.drainable.SetClock(result.clock)
+	return result
+}
+
+func (p *FakeProcess) boot(ctx context.Context) error {
+	p.lock.Lock()
+	n := p.boots
+	p.boots++
+	p.lock.Unlock()
+	if p.opt.BootLatency > 0 {
+		timer := p.clock.NewTimer(p.opt.BootLatency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+	if n < len(p.opt.BootErrors) && p.opt.BootErrors[n] != nil {
+		return p.opt.BootErrors[n]
+	}
+	if p.opt.Backend != nil {
+		if err := p.opt.Backend.Start(ctx); err != nil {
+			return err
+		}
+	}
+	p.lock.Lock()
+	p.pid = 1000 + n
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *FakeProcess) close() error {
+	p.lock.Lock()
+	p.pid = 0
+	p.lock.Unlock()
+	if p.opt.Backend != nil {
+		p.opt.Backend.Stop()
+	}
+	return p.opt.CloseError
+}
+
+// Exec implements saving.ProcessController.
+func (p *FakeProcess) Exec(callback func()) error {
+	return p.ExecContext(context.Background(), callback)
+}
+
+// ExecContext implements saving.ContextExecutor.
+func (p *FakeProcess) ExecContext(ctx context.Context, callback func()) error {
+	p.execs.Add(1)
+	return p.drainable.ExecContext(ctx, callback)
+}
+
+func (p *FakeProcess) IsWaking() bool {
+	return p.drainable.IsWaking()
+}
+
+func (p *FakeProcess) Status() saving.Status {
+	return p.drainable.Status()
+}
+
+// Pid returns fake pid while awake, or 0.
+func (p *FakeProcess) Pid() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pid
+}
+
+// Boots returns count of boots including failed ones.
+func (p *FakeProcess) Boots() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.boots
+}
+
+// Execs returns count of Exec calls.
+func (p *FakeProcess) Execs() int {
+	return int(p.execs.Load())
+}
+
+// Crash kills the backend while awake. Like the real controllers, the status stays Waked
+// and requests to the backend fail until the process drains.
+func (p *FakeProcess) Crash() error {
+	if p.Status() != saving.Waked {
+		return errors.New("process is not awake")
+	}
+	p.lock.Lock()
+	p.pid = 0
+	p.lock.Unlock()
+	if p.opt.Backend != nil {
+		return p.opt.Backend.Stop()
+	}
+	return nil
+}
+
+// Sleep drains the process as soon as running jobs finish. It reports whether draining starts.
+func (p *FakeProcess) Sleep() bool {
+	return p.drainable.Sleep()
+}
+
+// Drainable returns the underlying Drainable to observe transitions.
+func (p *FakeProcess) Drainable() *drainable.Drainable {
+	return p.drainable
+}
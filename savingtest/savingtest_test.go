@@ -0,0 +1,140 @@
+package savingtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving"
+	"github.com/shibukawa/saving/clock/clocktest"
+	"github.com/shibukawa/saving/savingtest"
+)
+
+func get(t *testing.T, backend *savingtest.Backend, path string) (int, string) {
+	t.Helper()
+	res, err := http.Get(backend.URL().JoinPath(path).String())
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestBackend(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Start(context.Background()))
+	defer backend.Stop()
+
+	status, body := get(t, backend, "/hello")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello from /hello", body)
+	backend.SetHealthStatus(http.StatusServiceUnavailable)
+	status, _ = get(t, backend, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, 1, backend.Requests())
+
+	assert.NoError(t, backend.Stop())
+	status, _ = get(t, backend, "/hello")
+	assert.Equal(t, 0, status)
+	assert.NoError(t, backend.Start(context.Background())) // restart on the same address
+	status, _ = get(t, backend, "/hello")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestFakeProcessWithBackend(t *testing.T) {
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{})
+	assert.NoError(t, err)
+	defer backend.Stop()
+	p := savingtest.NewFakeProcess(savingtest.FakeOptions{Backend: backend})
+	transitions := savingtest.RecordTransitions(p.Drainable())
+
+	assert.NoError(t, p.Exec(func() {
+		status, _ := get(t, backend, "/hello")
+		assert.Equal(t, http.StatusOK, status)
+	}))
+	assert.NotEqual(t, 0, p.Pid())
+
+	assert.NoError(t, p.Crash())
+	assert.Equal(t, saving.Waked, p.Status())
+	assert.NoError(t, p.Exec(func() {
+		status, _ := get(t, backend, "/hello")
+		assert.Equal(t, 0, status) // connection refused
+	}))
+
+	p.Sleep()
+	transitions.WaitFor(t, saving.Drained, time.Second)
+	savingtest.AssertTransitions(t, transitions, saving.Waking, saving.Waked, saving.Draining, saving.Drained)
+	assert.False(t, backend.Running())
+}
+
+func TestFakeProcessScript(t *testing.T) {
+	errBoot := errors.New("boot error")
+	clk := clocktest.NewFake(time.Now())
+	p := savingtest.NewFakeProcess(savingtest.FakeOptions{
+		BootLatency:  time.Second,
+		BootErrors:   []error{nil, errBoot},
+		DrainTimeout: time.Minute,
+		Clock:        clk,
+	})
+	transitions := savingtest.RecordTransitions(p.Drainable())
+
+	result := make(chan error)
+	go func() {
+		result <- p.Exec(func() {})
+	}()
+	clk.BlockUntil(1) // boot latency
+	assert.Equal(t, saving.Waking, p.Status())
+	clk.Advance(time.Second)
+	assert.NoError(t, <-result)
+
+	clk.Advance(time.Minute)
+	assert.Equal(t, saving.Drained, p.Status())
+
+	go func() {
+		result <- p.Exec(func() {})
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	assert.IsError(t, <-result, errBoot)
+	savingtest.AssertTransitions(t, transitions,
+		saving.Waking, saving.Waked, saving.Draining, saving.Drained, saving.Waking, saving.Failed)
+	assert.Equal(t, 2, p.Boots())
+	assert.Equal(t, 2, p.Execs())
+}
+
+func TestBackendDelaysOnFakeClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	backend, err := savingtest.NewBackend(savingtest.BackendOptions{StartupDelay: time.Second, Latency: time.Second})
+	assert.NoError(t, err)
+	defer backend.Stop()
+	// the backend uses the clock of the process without its own clock
+	p := savingtest.NewFakeProcess(savingtest.FakeOptions{Backend: backend, Clock: clk})
+
+	var body string
+	result := make(chan error)
+	go func() {
+		result <- p.Exec(func() {
+			response := make(chan string)
+			go func() {
+				_, body := get(t, backend, "/hello")
+				response <- body
+			}()
+			clk.BlockUntil(1) // latency
+			clk.Advance(time.Second)
+			body = <-response
+		})
+	}()
+	clk.BlockUntil(1) // startup delay
+	assert.False(t, backend.Running())
+	clk.Advance(time.Second)
+	assert.NoError(t, <-result)
+	assert.Equal(t, "hello from /hello", body)
+	assert.Equal(t, 1, backend.Requests())
+}
@@ -0,0 +1,78 @@
+package savingtest
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shibukawa/saving/drainable"
+)
+
+// TransitionRecorder records status changes of Drainable.
+type TransitionRecorder struct {
+	lock        sync.Mutex
+	changed     chan struct{}
+	transitions []drainable.Transition
+}
+
+// RecordTransitions starts recording. It replaces the observer set by Drainable.OnTransition.
+func RecordTransitions(d *drainable.Drainable) *TransitionRecorder {
+	result := &TransitionRecorder{changed: make(chan struct{})}
+	d.OnTransition(func(t drainable.Transition) {
+		result.lock.Lock()
+		defer result.lock.Unlock()
+		result.transitions = append(result.transitions, t)
+		close(result.changed)
+		result.changed = make(chan struct{})
+	})
+	return result
+}
+
+// Transitions returns recorded transitions.
+func (r *TransitionRecorder) Transitions() []drainable.Transition {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.transitions)
+}
+
+// Statuses returns destination statuses of recorded transitions.
+func (r *TransitionRecorder) Statuses() []drainable.Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := make([]drainable.Status, len(r.transitions))
+	for i, t := range r.transitions {
+		result[i] = t.To
+	}
+	return result
+}
+
+// WaitFor waits until the status is recorded. It fails t after timeout.
+func (r *TransitionRecorder) WaitFor(t testing.TB, status drainable.Status, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		r.lock.Lock()
+		found := slices.ContainsFunc(r.transitions, func(tr drainable.Transition) bool {
+			return tr.To == status
+		})
+		changed := r.changed
+		r.lock.Unlock()
+		if found {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("status %s is not reached in %s: %v", status, timeout, r.Statuses())
+		}
+	}
+}
+
+// AssertTransitions checks recorded statuses in order.
+func AssertTransitions(t testing.TB, r *TransitionRecorder, want ...drainable.Status) {
+	t.Helper()
+	if got := r.Statuses(); !slices.Equal(got, want) {
+		t.Fatalf("transitions are %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package saving
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+var ErrSchedule = errors.New("schedule error")
+
+// Schedule is a cron style schedule: "minute hour day-of-month month day-of-week".
+//
+// Each field accepts '*', numbers, ranges (1-5), lists (1,3,5) and steps (*/15, 9-17/2).
+// Day-of-week is 0-7 (0 and 7 are Sunday). Like cron, if both day-of-month and day-of-week
+// are restricted, either of them should match.
+type Schedule struct {
+	src        string
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	domStar    bool
+	dowStar    bool
+}
+
+// ParseSchedule parses cron style schedule.
+func ParseSchedule(src string) (*Schedule, error) {
+	fields := strings.Fields(src)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: 5 fields are expected: '%s'", ErrSchedule, src)
+	}
+	result := &Schedule{
+		src:     src,
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var errs []error
+	for _, f := range []struct {
+		dest     *uint64
+		src      string
+		min, max int
+	}{
+		{&result.minute, fields[0], 0, 59},
+		{&result.hour, fields[1], 0, 23},
+		{&result.dayOfMonth, fields[2], 1, 31},
+		{&result.month, fields[3], 1, 12},
+		{&result.dayOfWeek, fields[4], 0, 7},
+	} {
+		bits, err := parseScheduleField(f.src, f.min, f.max)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: '%s'", ErrSchedule, err.Error(), src))
+		}
+		*f.dest = bits
+	}
+	if result.dayOfWeek&(1<<7) != 0 {
+		result.dayOfWeek |= 1
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return result, nil
+}
+
+func parseScheduleField(src string, min, max int) (uint64, error) {
+	var result uint64
+	for _, item := range strings.Split(src, ",") {
+		rangeSrc, stepSrc, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			s, err := strconv.Atoi(stepSrc)
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step '%s'", item)
+			}
+			step = s
+		}
+		start, end := min, max
+		if rangeSrc != "*" {
+			startSrc, endSrc, isRange := strings.Cut(rangeSrc, "-")
+			s, err := strconv.Atoi(startSrc)
+			if err != nil || s < min || s > max {
+				return 0, fmt.Errorf("value should be %d-%d '%s'", min, max, item)
+			}
+			start, end = s, s
+			if isRange {
+				e, err := strconv.Atoi(endSrc)
+				if err != nil || e < start || e > max {
+					return 0, fmt.Errorf("invalid range '%s'", item)
+				}
+				end = e
+			} else if hasStep {
+				end = max
+			}
+		}
+		for i := start; i <= end; i += step {
+			result |= 1 << i
+		}
+	}
+	return result, nil
+}
+
+// Match reports whether the minute of t is in the schedule.
+func (s *Schedule) Match(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dayOfMonth&(1<<t.Day()) != 0
+	dow := s.dayOfWeek&(1<<int(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *Schedule) String() string {
+	return s.src
+}
+
+// ParseSchedules parses ';' separated schedules.
+func ParseSchedules(src string) ([]*Schedule, error) {
+	var result []*Schedule
+	var errs []error
+	for _, s := range strings.Split(src, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		schedule, err := ParseSchedule(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, schedule)
+	}
+	return result, errors.Join(errs...)
+}
+
+func matchSchedules(schedules []*Schedule, t time.Time) bool {
+	for _, s := range schedules {
+		if s.Match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleAwake reports whether the service should be awake at now: a schedule matches now,
+// or a schedule matches within preWake from now.
+func scheduleAwake(schedules []*Schedule, now time.Time, preWake time.Duration) bool {
+	end := now.Add(preWake)
+	for t := now.Truncate(time.Minute); !t.After(end); t = t.Add(time.Minute) {
+		if matchSchedules(schedules, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// startScheduler keeps the service awake during schedules through Drainable.
+//
+// The service is woken preWake before the schedule starts. If sleepOutside is true,
+// the service is drained as soon as the schedule ends, without waiting drain timeout.
+func startScheduler(ctx context.Context, drainable *Drainable, schedules []*Schedule, preWake time.Duration, sleepOutside bool, clk clock.Clock, logger *slog.Logger) {
+	if len(schedules) == 0 {
+		return
+	}
+	clk = clock.OrReal(clk)
+	go func() {
+		var release func()
+		for {
+			now := clk.Now()
+			// the timer is armed before Hold because Hold waits for the boot
+			timer := clk.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			awake := scheduleAwake(schedules, now, preWake)
+			if awake && release == nil {
+				logger.Info("schedule start")
+				r, err := drainable.Hold()
+				if err != nil {
+					logger.Warn("schedule wake error", "detail", err.Error())
+				} else {
+					release = r
+				}
+			} else if !awake && release != nil {
+				logger.Info("schedule end")
+				release()
+				release = nil
+				if sleepOutside {
+					drainable.Sleep()
+				}
+			}
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				if release != nil {
+					release()
+				}
+				return
+			case <-timer.C():
+			}
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package saving
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2025-06-02 is Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, time.June, day, hour, minute, 0, 0, time.Local)
+	}
+	testcases := []struct {
+		src  string
+		time time.Time
+		want bool
+	}{
+		{"* 9-17 * * 1-5", at(2, 9, 0), true},
+		{"* 9-17 * * 1-5", at(2, 17, 59), true},
+		{"* 9-17 * * 1-5", at(2, 18, 0), false},
+		{"* 9-17 * * 1-5", at(1, 10, 0), false}, // Sunday
+		{"*/15 * * * *", at(2, 10, 30), true},
+		{"*/15 * * * *", at(2, 10, 31), false},
+		{"0 9 * * 0,7", at(1, 9, 0), true},
+		{"0 9 * * 7", at(1, 9, 0), true},
+		{"30 8 1 * 1", at(1, 8, 30), true},  // day-of-month or day-of-week
+		{"30 8 1 * 1", at(2, 8, 30), true},  // day-of-month or day-of-week
+		{"30 8 1 * 1", at(3, 8, 30), false}, // day-of-month or day-of-week
+		{"0-29/10 12 * 6 *", at(3, 12, 20), true},
+		{"0-29/10 12 * 6 *", at(3, 12, 30), false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.src, func(t *testing.T) {
+			s, err := ParseSchedule(tc.src)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, s.Match(tc.time))
+		})
+	}
+}
+
+func TestParseScheduleError(t *testing.T) {
+	for _, src := range []string{"* * * *", "60 * * * *", "* 5-3 * * *", "*/0 * * * *", "* * 0 * *", "a * * * *"} {
+		_, err := ParseSchedule(src)
+		assert.IsError(t, err, ErrSchedule)
+	}
+	schedules, err := ParseSchedules("* 9-17 * * 1-5; 0 12 * * 6")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(schedules))
+}
+
+func TestScheduleAwake(t *testing.T) {
+	// 2025-06-02 is Monday
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2025, time.June, 2, hour, minute, second, 0, time.Local)
+	}
+	schedules, err := ParseSchedules("0 9 * * 1-5")
+	assert.NoError(t, err)
+	testcases := []struct {
+		name    string
+		time    time.Time
+		preWake time.Duration
+		want    bool
+	}{
+		{"before pre-wake", at(8, 44, 59), 15 * time.Minute, false},
+		{"pre-wake starts", at(8, 45, 0), 15 * time.Minute, true},
+		{"during pre-wake", at(8, 52, 30), 15 * time.Minute, true},
+		{"schedule", at(9, 0, 30), 15 * time.Minute, true},
+		{"schedule ends", at(9, 1, 0), 15 * time.Minute, false},
+		{"no pre-wake", at(8, 59, 0), 0, false},
+		{"pre-wake shorter than a minute", at(8, 59, 30), 30 * time.Second, true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, scheduleAwake(schedules, tc.time, tc.preWake))
+		})
+	}
+}
+
+func TestSchedulerPreWake(t *testing.T) {
+	// 2025-06-02 is Monday
+	clk := clocktest.NewFake(time.Date(2025, time.June, 2, 8, 40, 0, 0, time.Local))
+	drainable := NewDrainable(wait(0), wait(0), time.Hour, func(s Status) {})
+	drainable.SetClock(clk)
+	schedules, err := ParseSchedules("0 9 * * 1-5")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startScheduler(ctx, drainable, schedules, 15*time.Minute, false, clk, slog.Default())
+
+	// advance minute by minute and wait for the scheduler to arm the next timer
+	blockUntil := func(timers int) {
+		t.Helper()
+		armed := make(chan struct{})
+		go func() {
+			clk.BlockUntil(timers)
+			close(armed)
+		}()
+		select {
+		case <-armed:
+		case <-time.After(time.Second):
+			t.Fatal("scheduler doesn't arm the timer")
+		}
+	}
+	blockUntil(1)
+	advance := func(minutes, timers int) {
+		t.Helper()
+		for range minutes {
+			clk.Advance(time.Minute)
+			blockUntil(timers)
+		}
+	}
+	advance(4, 1)
+	assert.Equal(t, Drained, drainable.Status())
+	// 8:45: the service is woken and kept awake until the schedule ends
+	advance(1, 1)
+	// the hold stops drain timer armed by the wake
+	deadline := time.Now().Add(time.Second)
+	for drainable.Status() != Waked || clk.Waiters() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("service is not held")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	advance(15, 1)
+	assert.Equal(t, Waked, drainable.Status())
+	// 9:01: the hold is released, and drain timer starts
+	advance(1, 2)
+	assert.Equal(t, Waked, drainable.Status())
+	clk.Advance(time.Hour)
+	assert.Equal(t, Drained, drainable.Status())
+}
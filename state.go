@@ -0,0 +1,101 @@
+package saving
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultStateFilename = "SAVING_STATE.json"
+
+// State is written to the state file for monitoring.
+type State struct {
+	Status        string    `json:"status"`
+	SleepReason   string    `json:"sleep_reason,omitempty"` // Reason of the last early sleep
+	SleptAt       time.Time `json:"slept_at,omitzero"`      // Time of the last early sleep
+	Savings       Savings   `json:"savings"`
+	PeakQueued    int       `json:"peak_queued"`    // Max count of requests that waited for the last wake
+	QueueRejected uint64    `json:"queue_rejected"` // Count of requests rejected by queue limits
+	WakeRejected  uint64    `json:"wake_rejected"`  // Count of wake attempts rejected by wake limits
+}
+
+// stateRecorder keeps State and writes it to the file on each update.
+type stateRecorder struct {
+	path  string
+	lock  sync.Mutex
+	state State
+}
+
+func newStateRecorder(path string) *stateRecorder {
+	result := &stateRecorder{
+		path: path,
+		state: State{
+			Status: Drained.GoString(),
+		},
+	}
+	result.update(func(s *State) {})
+	return result
+}
+
+func (r *stateRecorder) update(f func(s *State)) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f(&r.state)
+	if r.path == "" {
+		return
+	}
+	content, err := json.Marshal(r.state)
+	if err != nil {
+		return
+	}
+	// write and rename to avoid reading partial file
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err == nil {
+		os.Rename(tmp, r.path)
+	}
+}
+
+func (r *stateRecorder) remove() {
+	if r != nil && r.path != "" {
+		os.Remove(r.path)
+	}
+}
+
+// recordQueue records queue depth of the last wake.
+func (r *stateRecorder) recordQueue(d *Drainable, logger *slog.Logger) {
+	peak := d.PeakQueued()
+	rejected := d.QueueRejected()
+	r.update(func(s *State) {
+		s.PeakQueued = peak
+		s.QueueRejected = rejected
+	})
+	if peak > 0 {
+		logger.Info("wake queue", slog.Int("peak_queued", peak), slog.Uint64("queue_rejected", rejected))
+	}
+}
+
+// ReadState reads the state file written by saving process.
+func ReadState(statePath string) (*State, error) {
+	content, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	var result State
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func NormalizeStatePath(statePath string) string {
+	if statePath == "" {
+		return filepath.Join(os.TempDir(), DefaultStateFilename)
+	}
+	return statePath
+}
@@ -0,0 +1,70 @@
+package saving
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// withStaticDir serves files in the static directory without waking the server process.
+//
+// Requests that don't match any file are passed to the server process.
+func withStaticDir(next http.Handler, opt ProxyOption) http.Handler {
+	if opt.StaticDir == "" {
+		return next
+	}
+	root, err := os.OpenRoot(opt.StaticDir)
+	if err != nil {
+		if opt.Logger != nil {
+			opt.Logger.Warn("static dir error", "detail", err.Error())
+		}
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !serveStaticFile(w, r, root) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func serveStaticFile(w http.ResponseWriter, r *http.Request, root *os.Root) bool {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") { // hidden files like .env
+			return false
+		}
+	}
+	if name == "" {
+		name = "."
+	}
+	stat, err := root.Stat(name)
+	if err != nil {
+		return false
+	}
+	if stat.IsDir() {
+		name = path.Join(name, "index.html")
+		stat, err = root.Stat(name)
+		if err != nil || stat.IsDir() {
+			return false
+		}
+	}
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	w.Header().Set("ETag", staticETag(stat))
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+	return true
+}
+
+func staticETag(stat fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+}
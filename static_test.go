@@ -0,0 +1,58 @@
+package saving
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestStaticDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>index</h1>"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "assets"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("console.log('hello')"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=1"), 0o644))
+
+	process := &stubProcess{status: Drained}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		process.Exec(func() {})
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := withStaticDir(next, ProxyOption{StaticDir: dir})
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<h1>index</h1>", w.Body.String())
+
+	w = get("/assets/app.js", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+
+	w = get("/assets/app.js", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get("/assets/app.js", http.Header{"Range": {"bytes=0-6"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "console", w.Body.String())
+	assert.Equal(t, int32(0), process.execs.Load())
+
+	assert.Equal(t, http.StatusTeapot, get("/api/users", nil).Code)
+	assert.Equal(t, http.StatusTeapot, get("/.env", nil).Code)
+	assert.Equal(t, http.StatusTeapot, get("/../../etc/passwd", nil).Code)
+	assert.Equal(t, int32(3), process.execs.Load())
+}
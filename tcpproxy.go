@@ -0,0 +1,119 @@
+package saving
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// ServeTCPProxy relays TCP connections on the listener to dest like tcp://localhost:5432 until ctx is done.
+//
+// Each connection is relayed inside process.ExecContext, so the server process is woken when
+// a client connects and kept awake until the connection is closed. The connection is closed
+// if the server process can't be woken, or opt.WakeLimiter rejects the client address while the
+// server process sleeps. The address in PROXY protocol header is used if the listener reads it.
+// opt.ProxyProtocolUpstream sends PROXY protocol header to dest. Server of the result is nil.
+func ServeTCPProxy(ctx context.Context, process ProcessController, listener net.Listener, dest *url.URL, opt ProxyOption) *ProxyServer {
+	logger := opt.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	result := &ProxyServer{
+		Listener: listener,
+		done:     make(chan struct{}),
+	}
+	var lock sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		lock.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+	}()
+	go func() {
+		defer close(result.done)
+		defer wg.Wait()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+					logger.Error("serve error", "addr", listener.Addr().String(), "detail", err.Error())
+				}
+				return
+			}
+			lock.Lock()
+			conns[conn] = struct{}{}
+			lock.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					lock.Lock()
+					delete(conns, conn)
+					lock.Unlock()
+					conn.Close()
+				}()
+				relayTCP(ctx, process, conn, dest, opt, logger)
+			}()
+		}
+	}()
+	return result
+}
+
+func relayTCP(ctx context.Context, process ProcessController, conn net.Conn, dest *url.URL, opt ProxyOption, logger *slog.Logger) {
+	// RemoteAddr returns the address in PROXY protocol header
+	if !allowWake(opt.WakeLimiter, process, conn.RemoteAddr(), clock.OrReal(opt.Clock).Now(), logger) {
+		return
+	}
+	err := execContext(ctx, process, func() {
+		var d net.Dialer
+		upstream, err := d.DialContext(ctx, "tcp", dest.Host)
+		if err != nil {
+			logger.Warn("proxy error", "kind", UpstreamRefused.String(), "source", conn.RemoteAddr().String(), "detail", err.Error())
+			return
+		}
+		defer upstream.Close()
+		stop := context.AfterFunc(ctx, func() { upstream.Close() })
+		defer stop()
+		if opt.ProxyProtocolUpstream != 0 {
+			if err := writeProxyHeader(upstream, opt.ProxyProtocolUpstream, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+				logger.Warn("proxy error", "kind", UpstreamRefused.String(), "source", conn.RemoteAddr().String(), "detail", err.Error())
+				return
+			}
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			pipe(upstream, conn)
+		}()
+		go func() {
+			defer wg.Done()
+			pipe(conn, upstream)
+		}()
+		wg.Wait()
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Warn("proxy error", "kind", WakeFailed.String(), "source", conn.RemoteAddr().String(), "detail", err.Error())
+	}
+}
+
+// pipe copies src to dst, and closes writing side of dst to pass EOF.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
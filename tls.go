@@ -0,0 +1,141 @@
+package saving
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrTLS = errors.New("tls error")
+
+// TLSReloadInterval is minimum interval to check modification of certificate files.
+var TLSReloadInterval = 2 * time.Second
+
+// TLSOption configures TLS termination on listening ports.
+type TLSOption struct {
+	CertFiles    []string // Certificate files. The certificate for the client is selected by SNI
+	KeyFiles     []string // Key files paired with CertFiles
+	ClientCAFile string   // CA certificates to verify client certificates. Empty means no client verification
+}
+
+// NewTLSConfig creates tls.Config that reloads certificate files when they are modified.
+//
+// Files are checked on handshakes at most once per TLSReloadInterval. If reload fails,
+// the previous certificates are used.
+func NewTLSConfig(opt TLSOption, logger *slog.Logger) (*tls.Config, error) {
+	if len(opt.CertFiles) == 0 || len(opt.CertFiles) != len(opt.KeyFiles) {
+		return nil, fmt.Errorf("%w: count of certificate files and key files should be same", ErrTLS)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	store := &certStore{opt: opt, logger: logger}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	store.checked = time.Now()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return store.config(), nil
+		},
+	}, nil
+}
+
+// certStore keeps certificates and reloads them when the files are modified.
+type certStore struct {
+	opt       TLSOption
+	logger    *slog.Logger
+	lock      sync.Mutex
+	checked   time.Time
+	versions  []string // modification time and size of each file
+	certs     []tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (s *certStore) files() []string {
+	result := slices.Concat(s.opt.CertFiles, s.opt.KeyFiles)
+	if s.opt.ClientCAFile != "" {
+		result = append(result, s.opt.ClientCAFile)
+	}
+	return result
+}
+
+func (s *certStore) fileVersions() []string {
+	var result []string
+	for _, f := range s.files() {
+		if stat, err := os.Stat(f); err == nil {
+			result = append(result, fmt.Sprintf("%d-%d", stat.ModTime().UnixNano(), stat.Size()))
+		} else {
+			result = append(result, "")
+		}
+	}
+	return result
+}
+
+// load should be called with lock.
+func (s *certStore) load() error {
+	versions := s.fileVersions()
+	var certs []tls.Certificate
+	for i, certFile := range s.opt.CertFiles {
+		cert, err := tls.LoadX509KeyPair(certFile, s.opt.KeyFiles[i])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrTLS, err)
+		}
+		certs = append(certs, cert)
+	}
+	var clientCAs *x509.CertPool
+	if s.opt.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.opt.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrTLS, err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: no certificates in '%s'", ErrTLS, s.opt.ClientCAFile)
+		}
+	}
+	s.versions = versions
+	s.certs = certs
+	s.clientCAs = clientCAs
+	return nil
+}
+
+func (s *certStore) config() *tls.Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now := time.Now(); now.Sub(s.checked) >= TLSReloadInterval {
+		s.checked = now
+		if !slices.Equal(s.versions, s.fileVersions()) {
+			if err := s.load(); err != nil {
+				s.logger.Warn("certificate reload error", "detail", err.Error())
+			} else {
+				s.logger.Info("certificate reloaded")
+			}
+		}
+	}
+	certs := s.certs
+	result := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			for i := range certs {
+				if hello.SupportsCertificate(&certs[i]) == nil {
+					return &certs[i], nil
+				}
+			}
+			return &certs[0], nil
+		},
+	}
+	if s.clientCAs != nil {
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+		result.ClientCAs = s.clientCAs
+	}
+	return result
+}
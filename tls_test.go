@@ -0,0 +1,200 @@
+package saving
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "saving test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue writes certificate and key files signed by the CA to dir.
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	result := x509.NewCertPool()
+	result.AddCert(ca.cert)
+	return result
+}
+
+// handshake runs TLS handshake between server and client configs and returns the server certificate.
+func handshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		conn := tls.Server(serverConn, server)
+		err = conn.Handshake()
+		conn.Close()
+		serverErr <- err
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	conn := tls.Client(clientConn, client)
+	err = conn.Handshake()
+	var cert *x509.Certificate
+	if err == nil {
+		cert = conn.ConnectionState().PeerCertificates[0]
+	}
+	conn.Close()
+	if err2 := <-serverErr; err2 != nil {
+		return nil, err2
+	}
+	return cert, err
+}
+
+func TestTLSConfigSNI(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certA, keyA := ca.issue(t, dir, "a.example.com", x509.ExtKeyUsageServerAuth)
+	certB, keyB := ca.issue(t, dir, "b.example.com", x509.ExtKeyUsageServerAuth)
+	config, err := NewTLSConfig(TLSOption{
+		CertFiles: []string{certA, certB},
+		KeyFiles:  []string{keyA, keyB},
+	}, nil)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		cert, err := handshake(t, config, &tls.Config{ServerName: name, RootCAs: ca.pool()})
+		assert.NoError(t, err)
+		assert.Equal(t, name, cert.Subject.CommonName)
+	}
+	// falls back to the first certificate
+	cert, err := handshake(t, config, &tls.Config{ServerName: "c.example.com", InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "a.example.com", cert.Subject.CommonName)
+}
+
+func TestTLSConfigReload(t *testing.T) {
+	interval := TLSReloadInterval
+	TLSReloadInterval = 0
+	t.Cleanup(func() { TLSReloadInterval = interval })
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "example.com", x509.ExtKeyUsageServerAuth)
+	config, err := NewTLSConfig(TLSOption{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}}, nil)
+	assert.NoError(t, err)
+	client := &tls.Config{ServerName: "example.com", RootCAs: ca.pool()}
+	before, err := handshake(t, config, client)
+	assert.NoError(t, err)
+
+	// broken file keeps the previous certificate
+	assert.NoError(t, os.WriteFile(certFile, []byte("broken"), 0o600))
+	cert, err := handshake(t, config, client)
+	assert.NoError(t, err)
+	assert.Equal(t, before.SerialNumber, cert.SerialNumber)
+
+	// renewed certificate is used without restart
+	ca.issue(t, dir, "example.com", x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	after, err := handshake(t, config, client)
+	assert.NoError(t, err)
+	assert.NotEqual(t, before.SerialNumber, after.SerialNumber)
+}
+
+func TestTLSConfigClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "example.com", x509.ExtKeyUsageServerAuth)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	config, err := NewTLSConfig(TLSOption{
+		CertFiles:    []string{certFile},
+		KeyFiles:     []string{keyFile},
+		ClientCAFile: caFile,
+	}, nil)
+	assert.NoError(t, err)
+
+	_, err = handshake(t, config, &tls.Config{ServerName: "example.com", RootCAs: ca.pool()})
+	assert.Error(t, err)
+
+	clientCertFile, clientKeyFile := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	assert.NoError(t, err)
+	_, err = handshake(t, config, &tls.Config{
+		ServerName:   "example.com",
+		RootCAs:      ca.pool(),
+		Certificates: []tls.Certificate{clientCert},
+	})
+	assert.NoError(t, err)
+}
+
+func TestNewTLSConfigError(t *testing.T) {
+	_, err := NewTLSConfig(TLSOption{}, nil)
+	assert.IsError(t, err, ErrTLS)
+	_, err = NewTLSConfig(TLSOption{CertFiles: []string{"missing.crt"}, KeyFiles: []string{"missing.key"}}, nil)
+	assert.IsError(t, err, ErrTLS)
+}
@@ -0,0 +1,282 @@
+package saving
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+// DefaultUDPFlowTimeout is default duration a UDP flow is kept without datagrams.
+const DefaultUDPFlowTimeout = 30 * time.Second
+
+// DefaultUDPMaxFlows is default max count of UDP flows of each port.
+const DefaultUDPMaxFlows = 1024
+
+// udpQueueSize is count of datagrams buffered for each client while the server process wakes.
+const udpQueueSize = 64
+
+// maxDatagramSize is the max size of UDP payload.
+const maxDatagramSize = 64 * 1024
+
+// udpMaxReadErrors is count of consecutive errors reading replies that closes the flow, like
+// ICMP port unreachable while nobody listens on the upstream port.
+const udpMaxReadErrors = 5
+
+// udpReadRetryDelay is delay after the first read error. It doubles on each consecutive error.
+const udpReadRetryDelay = 100 * time.Millisecond
+
+// ServeUDPProxy relays datagrams on conn to dest like udp://localhost:5353 until ctx is done.
+//
+// Each client address has its own flow that has its own socket to dest, so replies are sent back
+// to the client. A flow is served inside process.ExecContext, so datagrams while the server process
+// is waking are buffered and forwarded after it becomes healthy. The flow keeps the server process
+// awake until no datagrams pass in either direction for opt.UDPFlowTimeout.
+// Datagrams of new clients are dropped when opt.UDPMaxFlows flows exist, or when opt.WakeLimiter
+// rejects the client while the server process sleeps.
+// Server and Listener of the result are nil.
+func ServeUDPProxy(ctx context.Context, process ProcessController, conn net.PacketConn, dest *url.URL, opt ProxyOption) *ProxyServer {
+	logger := opt.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	flowTimeout := opt.UDPFlowTimeout
+	if flowTimeout == 0 {
+		flowTimeout = DefaultUDPFlowTimeout
+	}
+	maxFlows := opt.UDPMaxFlows
+	if maxFlows == 0 {
+		maxFlows = DefaultUDPMaxFlows
+	}
+	result := &ProxyServer{
+		PacketConn: conn,
+		done:       make(chan struct{}),
+	}
+	u := &udpProxy{
+		process:     process,
+		conn:        conn,
+		dest:        dest,
+		flowTimeout: flowTimeout,
+		maxFlows:    maxFlows,
+		wakeLimiter: opt.WakeLimiter,
+		clock:       clock.OrReal(opt.Clock),
+		logger:      logger,
+		flows:       make(map[string]*udpFlow),
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		defer close(result.done)
+		defer u.wg.Wait()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+					logger.Error("serve error", "addr", conn.LocalAddr().String(), "detail", err.Error())
+				}
+				return
+			}
+			u.receive(ctx, addr, bytes.Clone(buf[:n]))
+		}
+	}()
+	return result
+}
+
+type udpProxy struct {
+	process     ProcessController
+	conn        net.PacketConn
+	dest        *url.URL
+	flowTimeout time.Duration
+	maxFlows    int
+	wakeLimiter *WakeLimiter
+	clock       clock.Clock
+	logger      *slog.Logger
+	lock        sync.Mutex
+	flows       map[string]*udpFlow
+	wg          sync.WaitGroup
+}
+
+// udpFlow is datagrams from one client.
+type udpFlow struct {
+	client net.Addr
+	queue  chan []byte // datagrams not forwarded yet
+}
+
+// receive passes datagram from client to its flow, and starts the flow if it doesn't exist.
+func (u *udpProxy) receive(ctx context.Context, client net.Addr, datagram []byte) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	flow, ok := u.flows[client.String()]
+	if !ok {
+		if len(u.flows) >= u.maxFlows {
+			u.logger.Warn("udp datagram dropped", "source", client.String(), "flows", len(u.flows))
+			return
+		}
+		if !allowWake(u.wakeLimiter, u.process, client, u.clock.Now(), u.logger) {
+			return
+		}
+		flow = &udpFlow{client: client, queue: make(chan []byte, udpQueueSize)}
+		u.flows[client.String()] = flow
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.serveFlow(ctx, flow)
+		}()
+	}
+	select {
+	case flow.queue <- datagram:
+	default:
+		u.logger.Warn("udp datagram dropped", "source", client.String(), "queued", udpQueueSize)
+	}
+}
+
+// close removes the flow unless force is false and datagrams arrived after the last check.
+// Datagrams after that start a new flow.
+func (u *udpProxy) close(flow *udpFlow, force bool) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !force && len(flow.queue) > 0 {
+		return false
+	}
+	delete(u.flows, flow.client.String())
+	return true
+}
+
+func (u *udpProxy) serveFlow(ctx context.Context, flow *udpFlow) {
+	err := execContext(ctx, u.process, func() {
+		var d net.Dialer
+		upstream, err := d.DialContext(ctx, "udp", u.dest.Host)
+		if err != nil {
+			u.logger.Warn("proxy error", "kind", UpstreamRefused.String(), "source", flow.client.String(), "detail", err.Error())
+			u.close(flow, true)
+			return
+		}
+		defer upstream.Close()
+		stop := context.AfterFunc(ctx, func() { upstream.Close() })
+		defer stop()
+
+		// replies are sent back to the client from the listening socket
+		replied := make(chan struct{}, 1)
+		refused := make(chan error, 1)
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			buf := make([]byte, maxDatagramSize)
+			errs := 0
+			for {
+				n, err := upstream.Read(buf)
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					// like ECONNREFUSED while nobody listens. back off not to spin on repeated errors
+					errs++
+					if errs == udpMaxReadErrors {
+						refused <- err
+						return
+					}
+					retry := u.clock.NewTimer(udpReadRetryDelay << (errs - 1))
+					select {
+					case <-retry.C():
+					case <-finished:
+						retry.Stop()
+						return
+					}
+					continue
+				}
+				errs = 0
+				u.conn.WriteTo(buf[:n], flow.client)
+				select {
+				case replied <- struct{}{}:
+				default:
+				}
+			}
+		}()
+
+		idle := u.clock.NewTimer(u.flowTimeout)
+		defer idle.Stop()
+		for {
+			select {
+			case datagram := <-flow.queue:
+				upstream.Write(datagram)
+			case <-replied:
+			case err := <-refused:
+				u.logger.Warn("proxy error", "kind", UpstreamRefused.String(), "source", flow.client.String(), "detail", err.Error())
+				u.close(flow, true)
+				return
+			case <-idle.C():
+				if u.close(flow, false) {
+					return
+				}
+			case <-ctx.Done():
+				u.close(flow, true)
+				return
+			}
+			idle.Reset(u.flowTimeout)
+		}
+	})
+	if err != nil {
+		u.close(flow, true)
+		if ctx.Err() == nil {
+			u.logger.Warn("proxy error", "kind", WakeFailed.String(), "source", flow.client.String(), "detail", err.Error())
+		}
+	}
+}
+
+// procNetUDPFiles are lists of UDP sockets of Linux.
+var procNetUDPFiles = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// checkUDPListening reports whether a socket is bound to the port of target on this host.
+//
+// UDP has no handshake to check the server, so it checks sockets in /proc/net/udp instead.
+// It always returns true if the socket list is not available like non-Linux platforms.
+func checkUDPListening(target *url.URL) bool {
+	port, err := strconv.ParseUint(target.Port(), 10, 16)
+	if err != nil {
+		return false
+	}
+	available := false
+	for _, f := range procNetUDPFiles {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		available = true
+		if udpPortBound(content, uint16(port)) {
+			return true
+		}
+	}
+	return !available
+}
+
+// udpPortBound reports whether /proc/net/udp content has a socket bound to port.
+func udpPortBound(content []byte, port uint16) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Scan() // header
+	want := fmt.Sprintf(":%04X", port)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// local_address is like 0100007F:0035
+		if strings.HasSuffix(fields[1], want) {
+			return true
+		}
+	}
+	return false
+}
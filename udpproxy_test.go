@@ -0,0 +1,250 @@
+package saving_test
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving"
+	"github.com/shibukawa/saving/clock/clocktest"
+	"github.com/shibukawa/saving/savingtest"
+)
+
+// udpEcho is an upstream that sends back received datagrams and records their sources.
+type udpEcho struct {
+	conn    net.PacketConn
+	lock    sync.Mutex
+	sources map[string]bool
+}
+
+func startUDPEcho(t *testing.T) *udpEcho {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	result := &udpEcho{conn: conn, sources: make(map[string]bool)}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			result.lock.Lock()
+			result.sources[addr.String()] = true
+			result.lock.Unlock()
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return result
+}
+
+func (e *udpEcho) Sources() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.sources)
+}
+
+func startUDPProxy(t *testing.T, process saving.ProcessController, echo *udpEcho, opt saving.ProxyOption) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	dest := &url.URL{Scheme: "udp", Host: echo.conn.LocalAddr().String()}
+	server := saving.ServeUDPProxy(ctx, process, conn, dest, opt)
+	t.Cleanup(func() {
+		cancel()
+		<-server.Done()
+	})
+	return conn.LocalAddr().String()
+}
+
+func udpClient(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readDatagram(t *testing.T, conn net.Conn, timeout time.Duration) (string, error) {
+	t.Helper()
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func TestUDPProxyBuffersWhileWaking(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{BootLatency: 200 * time.Millisecond})
+	client := udpClient(t, startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: time.Minute}))
+
+	start := time.Now()
+	for _, text := range []string{"first", "second", "third"} {
+		_, err := client.Write([]byte(text))
+		assert.NoError(t, err)
+	}
+	// datagrams are forwarded in order after the wake
+	for _, text := range []string{"first", "second", "third"} {
+		got, err := readDatagram(t, client, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, text, got)
+	}
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+	assert.Equal(t, 1, process.Boots())
+}
+
+func TestUDPProxyFlowPerClient(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{})
+	addr := startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: time.Minute})
+
+	a := udpClient(t, addr)
+	b := udpClient(t, addr)
+	for i := 0; i < 2; i++ {
+		_, err := a.Write([]byte("from a"))
+		assert.NoError(t, err)
+		_, err = b.Write([]byte("from b"))
+		assert.NoError(t, err)
+		got, err := readDatagram(t, a, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "from a", got)
+		got, err = readDatagram(t, b, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "from b", got)
+	}
+	// each client has its own socket to the upstream, and it is reused by the flow
+	assert.Equal(t, 2, echo.Sources())
+	assert.Equal(t, 2, process.Execs())
+}
+
+func TestUDPProxyKeepsProcessAwake(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{DrainTimeout: 50 * time.Millisecond})
+	recorder := savingtest.RecordTransitions(process.Drainable())
+	client := udpClient(t, startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: 100 * time.Millisecond}))
+
+	for range 5 {
+		_, err := client.Write([]byte("ping"))
+		assert.NoError(t, err)
+		_, err = readDatagram(t, client, time.Second)
+		assert.NoError(t, err)
+		// the flow is active, so the idle process is not drained
+		time.Sleep(60 * time.Millisecond)
+		assert.Equal(t, saving.Waked, process.Status())
+	}
+	// the flow ends without datagrams, and then the process is drained
+	recorder.WaitFor(t, saving.Drained, time.Second)
+	assert.Equal(t, 1, process.Boots())
+}
+
+func TestUDPProxyWakeError(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{
+		BootErrors: []error{saving.ErrHealthCheckFailed},
+	})
+	client := udpClient(t, startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: time.Minute}))
+
+	_, err := client.Write([]byte("lost"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, client, 200*time.Millisecond)
+	assert.Error(t, err)
+
+	// the failed flow is removed, so the next datagram starts a new flow
+	_, err = client.Write([]byte("retry"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, client, 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, 2, process.Execs())
+	assert.Equal(t, saving.Failed, process.Status())
+}
+
+func TestUDPProxyMaxFlows(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{})
+	addr := startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: time.Minute, UDPMaxFlows: 1})
+
+	a := udpClient(t, addr)
+	_, err := a.Write([]byte("from a"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, a, time.Second)
+	assert.NoError(t, err)
+
+	// a new client over the limit is dropped, and the existing flow still works
+	b := udpClient(t, addr)
+	_, err = b.Write([]byte("from b"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, b, 200*time.Millisecond)
+	assert.Error(t, err)
+	_, err = a.Write([]byte("from a"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, a, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, echo.Sources())
+}
+
+func TestUDPProxyWakeLimit(t *testing.T) {
+	echo := startUDPEcho(t)
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{})
+	deny, err := saving.ParseCIDRs("127.0.0.0/8")
+	assert.NoError(t, err)
+	limiter := saving.NewWakeLimiter(0, 0, nil, deny)
+	client := udpClient(t, startUDPProxy(t, process, echo, saving.ProxyOption{UDPFlowTimeout: time.Minute, WakeLimiter: limiter}))
+
+	// the denied client can't wake the server process
+	_, err = client.Write([]byte("wake"))
+	assert.NoError(t, err)
+	_, err = readDatagram(t, client, 200*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, 0, process.Boots())
+	assert.Equal(t, uint64(1), limiter.Rejected())
+
+	// it is not limited while the server process is awake
+	assert.NoError(t, process.Exec(func() {}))
+	_, err = client.Write([]byte("awake"))
+	assert.NoError(t, err)
+	got, err := readDatagram(t, client, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "awake", got)
+}
+
+func TestUDPProxyUpstreamRefused(t *testing.T) {
+	// nobody listens on the upstream port, so each datagram gets ICMP port unreachable
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dest := &url.URL{Scheme: "udp", Host: closed.LocalAddr().String()}
+	closed.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clocktest.NewFake(time.Now())
+	process := savingtest.NewFakeProcess(savingtest.FakeOptions{})
+	saving.ServeUDPProxy(ctx, process, conn, dest, saving.ProxyOption{UDPFlowTimeout: time.Hour, Clock: clk})
+	client := udpClient(t, conn.LocalAddr().String())
+
+	// the flow waits between errors instead of spinning, and it is closed after repeated errors
+	for i := range 5 {
+		_, err := client.Write([]byte("ping"))
+		assert.NoError(t, err)
+		if i < 4 {
+			clk.BlockUntil(2) // flow timeout and retry delay
+			clk.Advance(time.Minute)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for clk.Waiters() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("flow is not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, process.Execs())
+}
@@ -0,0 +1,58 @@
+package saving
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrSocketInUse = errors.New("unix socket is in use")
+
+// unixSocketPrefix is the prefix of unix domain socket addresses in port maps like "unix:/run/app.sock".
+const unixSocketPrefix = "unix:"
+
+// listen binds addr that is TCP address like ":8080", or unix domain socket path like "unix:/run/app.sock".
+//
+// A stale socket file left by a killed process is removed before binding, and mode is applied to
+// the socket file if it is not zero.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	socketPath, ok := strings.CutPrefix(addr, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(socketPath, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path if no process listens on it.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("file exists and it is not a unix socket: '%s'", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: '%s'", ErrSocketInUse, path)
+	}
+	return os.Remove(path)
+}
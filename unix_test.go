@@ -0,0 +1,93 @@
+package saving
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// unixClient returns HTTP client that connects to socketPath.
+func unixClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+func serveUnix(t *testing.T, socketPath string, handler http.Handler) {
+	t.Helper()
+	l, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	// a socket file left by a killed process
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	assert.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:"+socketPath, 0o660)
+	assert.NoError(t, err)
+	stat, err := os.Stat(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), stat.Mode().Perm())
+
+	// the socket is in use
+	_, err = listen("unix:"+socketPath, 0)
+	assert.IsError(t, err, ErrSocketInUse)
+
+	l.Close()
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixSocketNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	assert.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+	_, err := listen("unix:"+path, 0)
+	assert.Error(t, err)
+	// the file is not removed
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestUnixSocketPortMap(t *testing.T) {
+	dir := t.TempDir()
+	front := filepath.Join(dir, "front.sock")
+	child := filepath.Join(dir, "child.sock")
+	t.Setenv("SAVING_PORT_MAPS", "unix:"+front+":unix:"+child)
+	opt, err := InitOption([]string{"server"})
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:"+front, opt.PortMaps[0].FromPort)
+	assert.Equal(t, "unix", opt.PortMaps[0].Destination.Scheme)
+	assert.Equal(t, child, opt.PortMaps[0].Destination.Path)
+
+	serveUnix(t, child, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	// health check uses the socket of the first upstream
+	assert.True(t, checkHealthContext(context.Background(), healthCheckClient(opt.HealthCheckTransport), readinessCheckTimeout, opt.HealthCheckUrl))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = NewSingleProxyServer(ctx, &stubProcess{status: Waked}, opt.PortMaps[0].FromPort, opt.PortMaps[0].Destination, ProxyOption{})
+	assert.NoError(t, err)
+	res, err := unixClient(front).Get("http://localhost/hello")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "hello from /hello", string(body))
+}
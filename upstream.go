@@ -0,0 +1,107 @@
+package saving
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var ErrUpstream = errors.New("upstream error")
+
+// UpstreamOption configures connections from saving to the server process.
+type UpstreamOption struct {
+	RootCAs            *x509.CertPool // CA certificates to verify https upstreams. nil means system roots
+	InsecureSkipVerify bool           // Don't verify certificates of https upstreams like self-signed certificates for development
+}
+
+// ParseUpstream parses the target of SAVING_PORT_MAPS.
+//
+// It accepts a port number for http://localhost:<port>, http://, https:// and h2c:// (HTTP/2 cleartext)
+// URLs, unix:<path> for HTTP over unix domain socket, tcp:// for raw TCP relay and udp:// for UDP datagram relay.
+// udp:// host should be this host because its health check reads sockets of this host.
+func ParseUpstream(src string) (*url.URL, error) {
+	if port, err := strconv.ParseUint(src, 10, 16); err == nil {
+		if port == 0 {
+			return nil, fmt.Errorf("%w: port should be 1-65535: '%s'", ErrUpstream, src)
+		}
+		return &url.URL{Scheme: "http", Host: net.JoinHostPort("localhost", src)}, nil
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUpstream, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "h2c", "tcp", "udp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%w: host is required: '%s'", ErrUpstream, src)
+		}
+	case "unix":
+		socketPath := u.Path
+		if u.Opaque != "" { // unix:relative/path.sock
+			socketPath = u.Opaque
+		}
+		if socketPath == "" {
+			return nil, fmt.Errorf("%w: socket path is required: '%s'", ErrUpstream, src)
+		}
+		return &url.URL{Scheme: "unix", Path: socketPath}, nil
+	default:
+		return nil, fmt.Errorf("%w: scheme should be http, https, h2c, unix, tcp or udp: '%s'", ErrUpstream, src)
+	}
+	if u.Scheme == "udp" && !isLocalHost(u.Hostname()) {
+		return nil, fmt.Errorf("%w: udp upstream should be on this host like localhost: '%s'", ErrUpstream, src)
+	}
+	return u, nil
+}
+
+// isLocalHost reports whether host is localhost, loopback address or address of network interfaces.
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUpstreamTransport returns http.RoundTripper to connect to dest, and the http or https URL
+// that requests to dest should be sent to with it.
+func NewUpstreamTransport(dest *url.URL, opt UpstreamOption) (http.RoundTripper, *url.URL) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	target := *dest
+	switch dest.Scheme {
+	case "https":
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:            opt.RootCAs,
+			InsecureSkipVerify: opt.InsecureSkipVerify,
+		}
+	case "h2c":
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		target.Scheme = "http"
+	case "unix":
+		socketPath := dest.Path
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		}
+		target = url.URL{Scheme: "http", Host: "localhost"}
+	}
+	return transport, &target
+}
@@ -0,0 +1,114 @@
+package saving
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestParseUpstream(t *testing.T) {
+	testcases := []struct {
+		name    string
+		src     string
+		want    url.URL
+		wantErr bool
+	}{
+		{"port", "8080", url.URL{Scheme: "http", Host: "localhost:8080"}, false},
+		{"http", "http://backend:8080", url.URL{Scheme: "http", Host: "backend:8080"}, false},
+		{"https", "https://localhost:8443/api", url.URL{Scheme: "https", Host: "localhost:8443", Path: "/api"}, false},
+		{"h2c", "h2c://localhost:50051", url.URL{Scheme: "h2c", Host: "localhost:50051"}, false},
+		{"unix absolute", "unix:/run/app.sock", url.URL{Scheme: "unix", Path: "/run/app.sock"}, false},
+		{"unix url", "unix:///run/app.sock", url.URL{Scheme: "unix", Path: "/run/app.sock"}, false},
+		{"unix relative", "unix:app.sock", url.URL{Scheme: "unix", Path: "app.sock"}, false},
+		{"port zero", "0", url.URL{}, true},
+		{"no host", "https://", url.URL{}, true},
+		{"no socket", "unix:", url.URL{}, true},
+		{"tcp", "tcp://localhost:5432", url.URL{Scheme: "tcp", Host: "localhost:5432"}, false},
+		{"udp", "udp://localhost:5353", url.URL{Scheme: "udp", Host: "localhost:5353"}, false},
+		{"udp loopback", "udp://127.0.0.1:5353", url.URL{Scheme: "udp", Host: "127.0.0.1:5353"}, false},
+		{"udp remote", "udp://dns.example.com:53", url.URL{}, true},
+		{"unknown scheme", "ftp://localhost:21", url.URL{}, true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := ParseUpstream(tc.src)
+			if tc.wantErr {
+				assert.IsError(t, err, ErrUpstream)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, *u)
+		})
+	}
+}
+
+func protoServer() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto+" "+r.URL.Path)
+	})
+}
+
+func proxyGet(t *testing.T, dest *url.URL, opt UpstreamOption) (int, string) {
+	t.Helper()
+	handler := NewHandler(&stubProcess{status: Waked}, dest, ProxyOption{Upstream: opt})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hello", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	backend := httptest.NewTLSServer(protoServer())
+	defer backend.Close()
+	dest, err := ParseUpstream(backend.URL)
+	assert.NoError(t, err)
+
+	// self-signed certificate is rejected by default
+	code, _ := proxyGet(t, dest, UpstreamOption{})
+	assert.Equal(t, http.StatusBadGateway, code)
+
+	code, body := proxyGet(t, dest, UpstreamOption{InsecureSkipVerify: true})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/1.1 /hello", body)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	code, body = proxyGet(t, dest, UpstreamOption{RootCAs: roots})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/1.1 /hello", body)
+}
+
+func TestH2CUpstream(t *testing.T) {
+	backend := httptest.NewUnstartedServer(protoServer())
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	dest, err := ParseUpstream("h2c://" + backend.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	code, body := proxyGet(t, dest, UpstreamOption{})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/2.0 /hello", body)
+}
+
+func TestUnixUpstream(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	backend := &http.Server{Handler: protoServer()}
+	go backend.Serve(listener)
+	defer backend.Close()
+	dest, err := ParseUpstream("unix:" + socketPath)
+	assert.NoError(t, err)
+
+	code, body := proxyGet(t, dest, UpstreamOption{})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "HTTP/1.1 /hello", body)
+}
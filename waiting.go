@@ -0,0 +1,103 @@
+package saving
+
+import (
+	"html/template"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRefreshInterval is used for waiting page when SAVING_RETRY_AFTER is not specified.
+const DefaultRefreshInterval = 2 * time.Second
+
+const defaultWaitingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>Please wait</title>
+<style>body{font-family:sans-serif;text-align:center;margin-top:20vh;color:#444}</style>
+</head>
+<body>
+<h1>Please wait</h1>
+<p>The service is starting up. This page reloads automatically in {{.RetryAfter}} seconds.</p>
+</body>
+</html>
+`
+
+// WaitingPageParams is passed to waiting page template.
+type WaitingPageParams struct {
+	Path       string // Requested path
+	RetryAfter int    // Refresh interval in seconds
+}
+
+// LoadWaitingPage loads waiting page template. "default" means built-in page.
+func LoadWaitingPage(src string) (*template.Template, error) {
+	if src == "default" {
+		return template.New("waiting").Parse(defaultWaitingPage)
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("waiting").Parse(string(content))
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// withWaiting returns waiting page or 503 immediately while the server process is waking.
+//
+// The wake keeps running in the background, so following requests reach the server process.
+func withWaiting(next http.Handler, process ProcessController, opt ProxyOption) http.Handler {
+	if opt.WaitingPage == nil && opt.RetryAfter == 0 {
+		return next
+	}
+	refresh := opt.RetryAfter
+	if refresh == 0 {
+		refresh = DefaultRefreshInterval
+	}
+	retryAfter := int(math.Ceil(refresh.Seconds()))
+	var wakingInBackground atomic.Bool
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch processStatus(process) {
+		case Waked, Failed:
+			next.ServeHTTP(w, r)
+			return
+		}
+		html := acceptsHTML(r)
+		if html && opt.WaitingPage == nil || !html && opt.RetryAfter == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wakingInBackground.CompareAndSwap(false, true) {
+			go func() {
+				defer wakingInBackground.Store(false)
+				process.Exec(func() {})
+			}()
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.Header().Set("Cache-Control", "no-store")
+		if html {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			err := opt.WaitingPage.Execute(w, WaitingPageParams{
+				Path:       r.URL.Path,
+				RetryAfter: retryAfter,
+			})
+			if err != nil && opt.Logger != nil {
+				opt.Logger.Warn("waiting page error", "detail", err.Error())
+			}
+		} else if isGRPC(r) {
+			writeGRPCError(w, "service is waking up", refresh)
+		} else {
+			http.Error(w, "service is waking up", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package saving
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestWaitingPage(t *testing.T) {
+	page, err := LoadWaitingPage("default")
+	assert.NoError(t, err)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	testcases := []struct {
+		name       string
+		opt        ProxyOption
+		status     Status
+		accept     string
+		want       int
+		retryAfter string
+	}{
+		{"browser while sleeping", ProxyOption{WaitingPage: page}, Drained, "text/html,*/*", http.StatusServiceUnavailable, "2"},
+		{"browser while awake", ProxyOption{WaitingPage: page}, Waked, "text/html,*/*", http.StatusTeapot, ""},
+		{"api without retry-after", ProxyOption{WaitingPage: page}, Drained, "application/json", http.StatusTeapot, ""},
+		{"api with retry-after", ProxyOption{RetryAfter: 5 * time.Second}, Waking, "application/json", http.StatusServiceUnavailable, "5"},
+		{"browser without waiting page", ProxyOption{RetryAfter: 5 * time.Second}, Drained, "text/html", http.StatusTeapot, ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			process := &stubProcess{status: tc.status}
+			handler := withWaiting(next, process, tc.opt)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tc.want, w.Code)
+			assert.Equal(t, tc.retryAfter, w.Header().Get("Retry-After"))
+			if tc.want == http.StatusServiceUnavailable && tc.opt.WaitingPage != nil {
+				assert.True(t, strings.Contains(w.Body.String(), `content="2"`))
+			}
+		})
+	}
+}
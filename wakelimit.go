@@ -0,0 +1,221 @@
+package saving
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shibukawa/saving/clock"
+)
+
+var ErrWakeLimit = errors.New("wake limit error")
+
+// ParseWakeLimit parses "count/duration" style limit like "3/1h".
+func ParseWakeLimit(src string) (burst int, per time.Duration, err error) {
+	countSrc, perSrc, found := strings.Cut(src, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("%w: count/duration is expected: '%s'", ErrWakeLimit, src)
+	}
+	burst, err = strconv.Atoi(strings.TrimSpace(countSrc))
+	if err != nil || burst < 1 {
+		return 0, 0, fmt.Errorf("%w: count should be positive number: '%s'", ErrWakeLimit, src)
+	}
+	per, err = time.ParseDuration(strings.TrimSpace(perSrc))
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("%w: duration is invalid: '%s'", ErrWakeLimit, src)
+	}
+	return burst, per, nil
+}
+
+// ParseCIDRs parses comma separated CIDR list. Single address is also acceptable.
+func ParseCIDRs(src string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	var errs []error
+	for _, s := range strings.Split(src, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid cidr: '%s'", s))
+			continue
+		}
+		result = append(result, cidr)
+	}
+	return result, errors.Join(errs...)
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// WakeLimiter limits requests that wake the server process by source address.
+//
+// Each source address has token bucket that holds burst tokens and refills burst tokens per duration.
+type WakeLimiter struct {
+	lock     sync.Mutex
+	burst    float64
+	rate     float64 // tokens per second
+	buckets  map[string]*tokenBucket
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	rejected atomic.Uint64
+	state    atomic.Pointer[stateRecorder] // records rejected count to the state file
+}
+
+// NewWakeLimiter creates WakeLimiter. burst=0 disables rate limit. Empty allow list allows any sources.
+func NewWakeLimiter(burst int, per time.Duration, allow, deny []*net.IPNet) *WakeLimiter {
+	result := &WakeLimiter{
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		allow:   allow,
+		deny:    deny,
+	}
+	if burst > 0 {
+		result.rate = float64(burst) / per.Seconds()
+	}
+	return result
+}
+
+// localSource is the bucket key of sources without IP address.
+const localSource = "local"
+
+// Allow consumes token of the source. It returns retryAfter>0 if the source is rate limited.
+//
+// nil ip is a source without IP address like peers of unix domain sockets. They are local
+// processes like a web server in front, so allow and deny lists don't apply to them, and
+// they share one bucket of the rate limit.
+func (l *WakeLimiter) Allow(ip net.IP, now time.Time) (allowed bool, retryAfter time.Duration) {
+	key := localSource
+	if ip != nil {
+		if containsIP(l.deny, ip) || len(l.allow) > 0 && !containsIP(l.allow, ip) {
+			l.reject()
+			return false, 0
+		}
+		key = ip.String()
+	}
+	if l.burst == 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.buckets) > 1024 {
+		l.prune(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		l.reject()
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune removes buckets that are already refilled.
+func (l *WakeLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *WakeLimiter) reject() {
+	rejected := l.rejected.Add(1)
+	l.state.Load().update(func(s *State) {
+		s.WakeRejected = rejected
+	})
+}
+
+// recordState makes the limiter record rejected count to wake_rejected of the state file.
+func (l *WakeLimiter) recordState(state *stateRecorder) {
+	if l != nil {
+		l.state.Store(state)
+	}
+}
+
+// Rejected returns count of rejected wake attempts.
+func (l *WakeLimiter) Rejected() uint64 {
+	return l.rejected.Load()
+}
+
+// allowWake reports whether a connection or a flow from addr can wake the server process.
+// It is for relays without HTTP, so rejections are only logged.
+func allowWake(limiter *WakeLimiter, process ProcessController, addr net.Addr, now time.Time, logger *slog.Logger) bool {
+	if limiter == nil {
+		return true
+	}
+	switch processStatus(process) {
+	case Drained, Draining: // only clients that trigger wake are limited
+	default:
+		return true
+	}
+	allowed, retryAfter := limiter.Allow(addrIP(addr), now)
+	if !allowed {
+		logger.Warn("wake rejected", slog.String("source", addr.String()),
+			slog.Bool("rate_limited", retryAfter > 0), slog.Uint64("rejected", limiter.Rejected()))
+	}
+	return allowed
+}
+
+// withWakeLimit rejects requests that would wake the server process if the source is not allowed.
+func withWakeLimit(next http.Handler, process ProcessController, opt ProxyOption) http.Handler {
+	if opt.WakeLimiter == nil {
+		return next
+	}
+	errorHandler := opt.errorHandler()
+	clk := clock.OrReal(opt.Clock)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch processStatus(process) {
+		case Drained, Draining: // only requests that trigger wake are limited
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		allowed, retryAfter := opt.WakeLimiter.Allow(ip, clk.Now())
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err := fmt.Errorf("%w: source %s can't wake the server process", ErrWakeLimit, r.RemoteAddr)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			errorHandler(w, r, WakeLimited, err)
+		} else {
+			errorHandler(w, r, WakeDenied, err)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package saving
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/shibukawa/saving/clock/clocktest"
+)
+
+func TestParseWakeLimit(t *testing.T) {
+	burst, per, err := ParseWakeLimit("3/1h")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, burst)
+	assert.Equal(t, time.Hour, per)
+
+	for _, src := range []string{"3", "0/1h", "3/forever", "x/1m"} {
+		_, _, err := ParseWakeLimit(src)
+		assert.IsError(t, err, ErrWakeLimit)
+	}
+}
+
+func TestWakeLimiterTokenBucket(t *testing.T) {
+	limiter := NewWakeLimiter(2, time.Minute, nil, nil)
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	ok, _ := limiter.Allow(ip, now)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(ip, now)
+	assert.True(t, ok)
+	ok, retryAfter := limiter.Allow(ip, now)
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	// other sources have own buckets
+	ok, _ = limiter.Allow(net.ParseIP("192.0.2.2"), now)
+	assert.True(t, ok)
+
+	// refilled
+	ok, _ = limiter.Allow(ip, now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), limiter.Rejected())
+}
+
+func TestWakeLimiterCIDR(t *testing.T) {
+	allow, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1")
+	assert.NoError(t, err)
+	deny, err := ParseCIDRs("10.0.0.1")
+	assert.NoError(t, err)
+	limiter := NewWakeLimiter(0, 0, allow, deny)
+	now := time.Now()
+
+	ok, _ := limiter.Allow(net.ParseIP("10.1.2.3"), now)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(net.ParseIP("192.0.2.1"), now)
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(net.ParseIP("10.0.0.1"), now)
+	assert.False(t, ok)
+	ok, _ = limiter.Allow(net.ParseIP("203.0.113.1"), now)
+	assert.False(t, ok)
+
+	_, err = ParseCIDRs("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestWakeLimitHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	process := &stubProcess{status: Drained}
+	deny, err := ParseCIDRs("203.0.113.0/24")
+	assert.NoError(t, err)
+	limiter := NewWakeLimiter(1, time.Hour, nil, deny)
+	state := newStateRecorder(filepath.Join(t.TempDir(), "state.json"))
+	limiter.recordState(state)
+	clk := clocktest.NewFake(time.Now())
+	handler := withWakeLimit(next, process, ProxyOption{WakeLimiter: limiter, Clock: clk})
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusTeapot, get("192.0.2.1:1234").Code)
+	w := get("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+	assert.Equal(t, "wake-limited", w.Header().Get(ErrorKindHeader))
+	w = get("203.0.113.7:1234")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "wake-denied", w.Header().Get(ErrorKindHeader))
+	assert.Equal(t, uint64(2), state.state.WakeRejected)
+
+	// the bucket is refilled by the clock
+	clk.Advance(time.Hour)
+	assert.Equal(t, http.StatusTeapot, get("192.0.2.1:1234").Code)
+
+	// requests while awake don't wake the process
+	process.status = Waked
+	assert.Equal(t, http.StatusTeapot, get("192.0.2.1:1234").Code)
+}
+
+func TestWakeLimitUnixSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	dest, _ := url.Parse(backend.URL)
+	socketPath := filepath.Join(t.TempDir(), "front.sock")
+	allow, err := ParseCIDRs("10.0.0.0/8")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = NewSingleProxyServer(ctx, &stubProcess{status: Drained}, "unix:"+socketPath, dest, ProxyOption{
+		WakeLimiter: NewWakeLimiter(1, time.Hour, allow, nil),
+	})
+	assert.NoError(t, err)
+
+	get := func() int {
+		res, err := unixClient(socketPath).Get("http://localhost/")
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// clients of unix socket have no address, so the allow list doesn't reject them
+	assert.Equal(t, http.StatusTeapot, get())
+	// but they share one bucket of the rate limit
+	assert.Equal(t, http.StatusTooManyRequests, get())
+}